@@ -0,0 +1,158 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// NewBatchController initializes a new instance of our batch controller.
+func NewBatchController(host string, store Store,
+	config *Config) *BatchController {
+
+	return &BatchController{host, store, config}
+}
+
+// A BatchController handles requests applying a batch of operations on
+// studies, trials, and files in a single transaction.
+type BatchController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// Post handles POST requests for `/batch`, applying the list of operations
+// sent in order, in a single transaction, and responding with the result
+// of each.  Operations that fail are skipped, unless the `atomic=true`
+// query parameter is given: then the first failure rolls back the whole
+// batch, and the response carries the status of the failed operation.
+func (c *BatchController) Post(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+
+	atomic, err := boolParam(r, "atomic")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var ops []Operation
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := author(r)
+	var results []*OperationResult
+	failed := -1 // index of the operation failing an atomic batch
+	err = c.store.Update(func(tx Tx) error {
+		results = make([]*OperationResult, len(ops))
+		for i, op := range ops {
+			result, err := op.apply(tx, user)
+			switch e := err.(type) {
+			case nil:
+			case *statusError:
+				result = &OperationResult{ID: op.ID, Status: e.status,
+					Detail: e.msg}
+			case *dataError:
+				result = &OperationResult{ID: op.ID,
+					Status:     http.StatusUnprocessableEntity,
+					Detail:     e.Error(),
+					Violations: e.violations,
+				}
+			default:
+				return err
+			}
+			results[i] = result
+			if err != nil && atomic {
+				failed = i
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && failed < 0 {
+		fail(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if failed >= 0 {
+		status = results[failed].Status
+		detail := fmt.Sprintf("not applied (operation %d failed)", failed)
+		for i, op := range ops {
+			if i != failed {
+				results[i] = &OperationResult{ID: op.ID,
+					Status: http.StatusFailedDependency, Detail: detail}
+			}
+		}
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, status, data)
+}
+
+// apply applies the operation within tx on behalf of user, returning its
+// result.  Operations that can't be applied fail with a statusError (or a
+// dataError) before changing anything.
+func (op *Operation) apply(tx Tx, user string) (*OperationResult, error) {
+	switch op.Op {
+	case "create", "update", "delete":
+	default:
+		return nil, errorf(http.StatusUnprocessableEntity, "invalid "+
+			"operation %q on %s (expecting create, update, or delete)",
+			op.Op, op.ID)
+	}
+	if err := checkID(op.ID); err != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	old, err := getRecord(tx, op.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMatch(op.ETag, op.ID, old); err != nil {
+		return nil, err
+	}
+
+	result := &OperationResult{ID: op.ID, Status: http.StatusOK}
+	switch op.Op {
+	case "create", "update":
+		if len(op.Data) == 0 {
+			return nil, errorf(http.StatusUnprocessableEntity,
+				"missing data payload for %s", op.ID)
+		}
+		if op.Op == "create" && old != nil {
+			return nil, errorf(http.StatusConflict, "%s already exists",
+				op.ID)
+		}
+		if op.Op == "update" && old == nil {
+			return nil, errorf(http.StatusNotFound, "%s not found", op.ID)
+		}
+		if old == nil {
+			result.Status = http.StatusCreated
+			if resourceType(op.ID) == "study" {
+				if err := listStudy(tx, op.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		rec, err := putRecord(tx, op.ID, old, op.Data, user)
+		if err != nil {
+			return nil, err
+		}
+		result.ETag = rec.ETag()
+	case "delete":
+		if old == nil {
+			return nil, errorf(http.StatusNotFound, "%s not found", op.ID)
+		}
+		summary, err := moveToTrash(tx, op.ID, trashRoots(op.ID), user)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted = summary
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An OperationResult models the outcome of an operation in a batch.
+type OperationResult struct {
+	ID      string `json:"id"`
+	Status  int    `json:"status"`
+	ETag    string `json:"etag"`
+	Deleted *struct {
+		Trials int `json:"trials"`
+		Files  int `json:"files"`
+	} `json:"deleted"`
+	Detail string `json:"detail"`
+}
+
+// Ensure batches of operations are applied in a single transaction.
+func TestBatch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for path, doc := range map[string]string{
+		"/studies/a/trials/t1": `{"n":1}`,
+		"/files/a/t1/f1":       `{"n":1}`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	batch := `[
+		{"op":"create","id":"/studies/b","data":{"name":"B"}},
+		{"op":"create","id":"/studies/b/trials/t1","data":{"n":1}},
+		{"op":"create","id":"/files/b/t1/f1","data":{"n":1}},
+		{"op":"update","id":"/studies/b/trials/t1","data":{"n":2}},
+		{"op":"create","id":"/studies/a/trials/t1","data":{"n":2}},
+		{"op":"update","id":"/studies/a/trials/t2","data":{"n":2}},
+		{"op":"update","id":"/files/a/t1/f1","data":{"n":2},"etag":"\"2\""},
+		{"op":"create","id":"/studies/a/trials/files","data":{}},
+		{"op":"create","id":"/studies/a/trials/t3"},
+		{"op":"move","id":"/studies/a"},
+		{"op":"delete","id":"/studies/a/trials/t1"}
+	]`
+	results, code := postBatch(t, srv.addr+"/batch", batch)
+	if want := http.StatusOK; want != code {
+		t.Fatalf("want %d, got %d", want, code)
+	}
+	var statuses []int
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	want := []int{201, 201, 201, 200, 409, 404, 412, 422, 422, 422, 200}
+	if !reflect.DeepEqual(want, statuses) {
+		t.Fatalf("want statuses %v, got %v", want, statuses)
+	}
+	if want, got := `"2"`, results[3].ETag; want != got {
+		t.Errorf("want etag %s, got %s", want, got)
+	}
+	if d := results[10].Deleted; d == nil || d.Trials != 1 || d.Files != 1 {
+		t.Errorf("want 1 trial and 1 file deleted, got %+v", d)
+	}
+
+	got, _ := json.Marshal(getDocument(t, srv.addr+"/studies/b/trials/t1"))
+	if want := `{"n":2}`; want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if want, got := http.StatusOK, status(t, "GET",
+		srv.addr+"/studies/b"); want != got {
+		t.Errorf("want study b listed, got %d", got)
+	}
+	for _, path := range []string{"/studies/a/trials/t1", "/files/a/t1/f1"} {
+		if want, got := http.StatusNotFound,
+			status(t, "GET", srv.addr+path); want != got {
+			t.Errorf("GET %s: want %d, got %d", path, want, got)
+		}
+	}
+
+	// An atomic batch is applied in full or not at all.
+	batch = `[
+		{"op":"update","id":"/studies/b/trials/t1","data":{"n":3}},
+		{"op":"delete","id":"/studies/b/trials/t2"},
+		{"op":"create","id":"/studies/b/trials/t3","data":{}}
+	]`
+	results, code = postBatch(t, srv.addr+"/batch?atomic=true", batch)
+	if want := http.StatusNotFound; want != code {
+		t.Fatalf("want %d, got %d", want, code)
+	}
+	statuses = nil
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []int{424, 404, 424}; !reflect.DeepEqual(want, statuses) {
+		t.Errorf("want statuses %v, got %v", want, statuses)
+	}
+	got, _ = json.Marshal(getDocument(t, srv.addr+"/studies/b/trials/t1"))
+	if want := `{"n":2}`; want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	batch = `[{"op":"delete","id":"/studies/b"}]`
+	results, code = postBatch(t, srv.addr+"/batch?atomic=true", batch)
+	if want := http.StatusOK; want != code || len(results) != 1 {
+		t.Fatalf("want %d, got %d", want, code)
+	}
+	if want, got := http.StatusNotFound,
+		status(t, "GET", srv.addr+"/studies/b"); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+
+	for _, tt := range []struct{ query, body string }{
+		{"", `{"op":"delete","id":"/studies/b"}`},
+		{"", `[{"op":"delete"`},
+		{"?atomic=yes", `[]`},
+	} {
+		_, code := postBatch(t, srv.addr+"/batch"+tt.query, tt.body)
+		if want := http.StatusBadRequest; want != code {
+			t.Errorf("batch %s%s: want %d, got %d", tt.query, tt.body, want,
+				code)
+		}
+	}
+}
+
+// postBatch posts the batch of operations to url, returning the results
+// and the response status.
+func postBatch(t *testing.T, url, batch string) ([]OperationResult, int) {
+	res := send(t, "POST", url, strings.NewReader(batch))
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusBadRequest {
+		return nil, res.StatusCode
+	}
+	var results []OperationResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatalf("error decoding batch results: %v", err)
+	}
+	return results, res.StatusCode
+}
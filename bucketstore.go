@@ -0,0 +1,271 @@
+package xhub
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+	"github.com/joyrexus/buckets"
+)
+
+// OpenBucketStore opens (or creates) the buckets database at path,
+// returning a store backed by it.
+func OpenBucketStore(path string) (*BucketStore, error) {
+	bux, err := buckets.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewBucketStore(bux), nil
+}
+
+// NewBucketStore returns a store backed by an open buckets database.
+func NewBucketStore(bux *buckets.DB) *BucketStore {
+	return &BucketStore{bux}
+}
+
+// A BucketStore is a Store persisting items in a buckets (boltdb) database.
+// Each store transaction is a bolt transaction, and buckets are created as
+// needed when first written to.
+type BucketStore struct {
+	db *buckets.DB
+}
+
+// View calls fn with a read-only bolt transaction.
+func (s *BucketStore) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+// Update calls fn with a read-write bolt transaction.
+func (s *BucketStore) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+// Get returns the value stored under key in bucket.
+func (s *BucketStore) Get(bucket, key []byte) (value []byte, err error) {
+	err = s.View(func(tx Tx) error {
+		value, err = tx.Get(bucket, key)
+		return err
+	})
+	return value, err
+}
+
+// Put stores value under key in bucket.
+func (s *BucketStore) Put(bucket, key, value []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+// Delete removes key from bucket.
+func (s *BucketStore) Delete(bucket, key []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+// Children returns the items in bucket that are direct children of parent.
+func (s *BucketStore) Children(bucket, parent []byte) (items []Item,
+	err error) {
+
+	err = s.View(func(tx Tx) error {
+		items, err = tx.Children(bucket, parent)
+		return err
+	})
+	return items, err
+}
+
+// EachChild calls fn for each item in bucket that is a direct child of
+// parent, within a single read-only transaction.
+func (s *BucketStore) EachChild(bucket, parent []byte,
+	fn func(Item) error) error {
+
+	return s.View(func(tx Tx) error {
+		return tx.EachChild(bucket, parent, fn)
+	})
+}
+
+// EachRange calls fn for each item in bucket with a key from from up to
+// to, within a single read-only transaction.
+func (s *BucketStore) EachRange(bucket, from, to []byte,
+	fn func(Item) error) error {
+
+	return s.View(func(tx Tx) error {
+		return tx.EachRange(bucket, from, to, fn)
+	})
+}
+
+// DeleteTree removes root and all of its descendants from bucket,
+// returning the items removed.
+func (s *BucketStore) DeleteTree(bucket, root []byte) (items []Item,
+	err error) {
+
+	err = s.Update(func(tx Tx) error {
+		items, err = tx.DeleteTree(bucket, root)
+		return err
+	})
+	return items, err
+}
+
+// Items returns all items in bucket.
+func (s *BucketStore) Items(bucket []byte) (items []Item, err error) {
+	err = s.View(func(tx Tx) error {
+		items, err = tx.Items(bucket)
+		return err
+	})
+	return items, err
+}
+
+// Close closes the underlying buckets database.
+func (s *BucketStore) Close() error {
+	return s.db.Close()
+}
+
+// A boltTx is a store transaction backed by a bolt transaction.
+//
+// Keys and values handed out by bolt are only valid for the life of the
+// transaction, so they're copied before being returned.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// bucket returns the named bucket, creating it in writable transactions
+// if necessary.  In read-only transactions, the bucket returned is nil if
+// it doesn't exist yet.
+func (t *boltTx) bucket(name []byte) (*bolt.Bucket, error) {
+	if !t.tx.Writable() {
+		return t.tx.Bucket(name), nil
+	}
+	return t.tx.CreateBucketIfNotExists(name)
+}
+
+// Get returns the value stored under key in bucket.
+func (t *boltTx) Get(bucket, key []byte) ([]byte, error) {
+	bk, err := t.bucket(bucket)
+	if bk == nil {
+		return nil, err
+	}
+	return clone(bk.Get(key)), nil
+}
+
+// Put stores value under key in bucket.
+func (t *boltTx) Put(bucket, key, value []byte) error {
+	bk, err := t.bucket(bucket)
+	if bk == nil {
+		if err == nil {
+			err = bolt.ErrTxNotWritable
+		}
+		return err
+	}
+	return bk.Put(key, value)
+}
+
+// Delete removes key from bucket.
+func (t *boltTx) Delete(bucket, key []byte) error {
+	bk, err := t.bucket(bucket)
+	if bk == nil {
+		return err
+	}
+	return bk.Delete(key)
+}
+
+// Children returns the items in bucket that are direct children of parent.
+func (t *boltTx) Children(bucket, parent []byte) ([]Item, error) {
+	prefix := descendantPrefix(parent)
+	items := []Item{}
+	err := t.scan(bucket, prefix, func(k, v []byte) error {
+		if isChild(prefix, k) {
+			items = append(items, Item{clone(k), clone(v)})
+		}
+		return nil
+	})
+	return items, err
+}
+
+// EachChild calls fn for each item in bucket that is a direct child of
+// parent, as a bolt cursor reaches it.
+func (t *boltTx) EachChild(bucket, parent []byte, fn func(Item) error) error {
+	prefix := descendantPrefix(parent)
+	return t.scan(bucket, prefix, func(k, v []byte) error {
+		if !isChild(prefix, k) {
+			return nil
+		}
+		return fn(Item{clone(k), clone(v)})
+	})
+}
+
+// EachRange calls fn for each item in bucket with a key from from up to
+// to, as a bolt cursor reaches it.
+func (t *boltTx) EachRange(bucket, from, to []byte, fn func(Item) error) error {
+	bk, err := t.bucket(bucket)
+	if bk == nil {
+		return err
+	}
+	c := bk.Cursor()
+	for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+		if to != nil && bytes.Compare(k, to) >= 0 {
+			break
+		}
+		if err := fn(Item{clone(k), clone(v)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTree removes root and all of its descendants from bucket,
+// returning the items removed.
+func (t *boltTx) DeleteTree(bucket, root []byte) ([]Item, error) {
+	var items []Item
+	v, err := t.Get(bucket, root)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		items = append(items, Item{clone(root), v})
+	}
+	err = t.scan(bucket, descendantPrefix(root), func(k, v []byte) error {
+		items = append(items, Item{clone(k), clone(v)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := t.Delete(bucket, item.Key); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Items returns all items in bucket.
+func (t *boltTx) Items(bucket []byte) ([]Item, error) {
+	items := []Item{}
+	err := t.scan(bucket, nil, func(k, v []byte) error {
+		items = append(items, Item{clone(k), clone(v)})
+		return nil
+	})
+	return items, err
+}
+
+// scan calls fn for each item in bucket whose key begins with prefix, in
+// key order.
+func (t *boltTx) scan(bucket, prefix []byte, fn func(k, v []byte) error) error {
+	bk, err := t.bucket(bucket)
+	if bk == nil {
+		return err
+	}
+	c := bk.Cursor()
+	for k, v := c.Seek(prefix); k != nil; k, v = c.Next() {
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
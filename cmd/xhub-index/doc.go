@@ -0,0 +1,20 @@
+/*
+xhub-index is a command for declaring and rebuilding the indexes of an xhub
+database.  The server must not be running, as it holds the database open.
+
+Usage:
+	xhub-index [flags] [TYPE:PATH ...]
+
+Each argument declares an index on the path PATH within the data payloads
+of resources of type TYPE (`study`, `trial`, or `file`), e.g.
+`trial:data.subject`.  The indexes given replace any declared before, and
+are built from the resources in the database.  Without any arguments, the
+indexes already declared are rebuilt.
+
+The flags are:
+	-dbfile
+		name of the boltdb file for persisting xhub data (`xhub.db`)
+	-clear
+		drop all indexes
+*/
+package main
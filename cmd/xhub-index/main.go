@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joyrexus/xhub"
+)
+
+var (
+	dbfile string
+	clear  bool
+)
+
+func main() {
+	flag.StringVar(&dbfile, "dbfile", "xhub.db", "path to database file")
+	flag.BoolVar(&clear, "clear", false, "drop all indexes")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: xhub-index [flags] [TYPE:PATH ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	indexes := xhub.Indexes{}
+	for _, arg := range flag.Args() {
+		i := strings.Index(arg, ":")
+		if i < 0 {
+			log.Fatalf("invalid index %q: expecting TYPE:PATH\n", arg)
+		}
+		typ, path := arg[:i], arg[i+1:]
+		indexes[typ] = append(indexes[typ], path)
+	}
+
+	srv := xhub.NewServer("", dbfile)
+	defer srv.Close()
+
+	// Without any indexes given, rebuild the ones already declared.
+	if len(indexes) == 0 && !clear {
+		declared, err := srv.Indexes()
+		if err != nil {
+			log.Fatalf("couldn't read declared indexes: %v\n", err)
+		}
+		indexes = declared
+	}
+	if err := srv.Reindex(indexes); err != nil {
+		log.Fatalf("couldn't build indexes: %v\n", err)
+	}
+	for typ, paths := range indexes {
+		for _, path := range paths {
+			log.Printf("indexed %s:%s\n", typ, path)
+		}
+	}
+}
@@ -9,5 +9,15 @@ The flags are:
 		host name or ip address (`localhost:8081`)
 	-dbfile
 		name of the boltdb file for persisting xhub data (`xhub.db`)
+	-idempotency
+		how long the response to a POST request with an Idempotency-Key
+		header is replayed to retries sending the same key (`24h`); a
+		window of 0 ignores the header
+	-nocontent
+		respond to requests for missing resources with 204 No Content
+		rather than 404 Not Found, as older xpub clients expect
+	-retention
+		how long deleted resources are kept in the trash before being
+		purged for good (`720h`); a retention of 0 keeps them forever
 */
 package main
@@ -3,20 +3,57 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/joyrexus/xhub"
 )
 
 var (
-	addr   string
-	dbfile string
+	addr      string
+	dbfile    string
+	nocontent bool
+	retention time.Duration
+	window    time.Duration
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", "localhost:8081", "host name or ip address")
 	flag.StringVar(&dbfile, "dbfile", "xhub.db", "path to database file")
+	flag.BoolVar(&nocontent, "nocontent", false,
+		"respond to requests for missing resources with 204 No Content")
+	flag.DurationVar(&retention, "retention", 30*24*time.Hour,
+		"how long deleted resources are kept in the trash (0 keeps them)")
+	flag.DurationVar(&window, "idempotency", xhub.DefaultIdempotencyWindow,
+		"how long responses to requests with idempotency keys are "+
+			"replayed (0 ignores the keys)")
 	flag.Parse()
 
 	srv := xhub.NewServer(addr, dbfile)
+	srv.Config.LegacyNoContent = nocontent
+	srv.Config.IdempotencyWindow = window
+	go purge(srv)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// purge periodically purges resources deleted more than the retention
+// period ago from the trash, along with the responses kept for idempotency
+// keys once their window has passed.
+func purge(srv *xhub.Server) {
+	for {
+		if retention > 0 {
+			n, err := srv.PurgeTrash(retention)
+			if err != nil {
+				log.Printf("couldn't purge trash: %v\n", err)
+			} else if n > 0 {
+				log.Printf("purged %d deleted resources from trash\n", n)
+			}
+		}
+		n, err := srv.PurgeResponses()
+		if err != nil {
+			log.Printf("couldn't purge idempotency keys: %v\n", err)
+		} else if n > 0 {
+			log.Printf("purged %d expired idempotency keys\n", n)
+		}
+		time.Sleep(time.Hour)
+	}
+}
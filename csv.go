@@ -0,0 +1,371 @@
+package xhub
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// csvType is the media type of comma-separated values.
+const csvType = "text/csv"
+
+// trialColumn is the header of the column naming the trial on each row of
+// a csv file of trials.  The other columns hold the values within the
+// trials' data payloads, headed by their dotted paths (e.g., `subject.name`
+// for the name member of the subject object).
+const trialColumn = "trial"
+
+// columnName returns the header of the column holding the value at the
+// dotted path within a trial's data payload.  Values within a member named
+// like the trial column or "data" are headed by their full path (e.g.,
+// `data.trial`), so that they don't clash with the trial column or pass
+// for full paths themselves.
+func columnName(path string) string {
+	name := strings.SplitN(path, ".", 2)[0]
+	if name == trialColumn || name == "data" {
+		return "data." + path
+	}
+	return path
+}
+
+// columnPath returns the full path (e.g., `data.subject.name`) of the value
+// held by the column headed column, the reverse of columnName.
+func columnPath(column string) string {
+	if strings.HasPrefix(column, "data.") {
+		return column
+	}
+	return "data." + column
+}
+
+// isCSV reports whether the body of r is a csv file.
+func isCSV(r *http.Request) bool {
+	typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return typ == csvType
+}
+
+// flatten adds the values within the decoded json value v at path to row,
+// keyed by their dotted paths.  Objects are flattened into their members,
+// while other values are formatted as cells (see formatCell).
+func flatten(row map[string]string, path string, v interface{}) {
+	obj, ok := v.(map[string]interface{})
+	if !ok || (len(obj) == 0 && path != "") {
+		row[path] = formatCell(v)
+		return
+	}
+	for name, member := range obj {
+		if path != "" {
+			name = path + "." + name
+		}
+		flatten(row, name, member)
+	}
+}
+
+// formatCell formats the decoded json value v as the text of a csv cell,
+// such that parseCell gives back v: strings as they are, unless they'd be
+// parsed as json (e.g., "true"), and other values as json.
+func formatCell(v interface{}) string {
+	if s, ok := v.(string); ok && s != "" {
+		if _, err := decodeJSON([]byte(s)); err != nil {
+			return s
+		}
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// parseCell parses the text of a csv cell as a json value, reporting
+// whether the cell holds a value at all.  Text that is json is decoded as
+// such (so a quoted json string is taken without its quotes), and other
+// text is taken as a string.  Empty cells hold no value.
+func parseCell(text string) (interface{}, bool) {
+	if text == "" {
+		return nil, false
+	}
+	if v, err := decodeJSON([]byte(text)); err == nil {
+		return v, true
+	}
+	return text, true
+}
+
+// exportTrials handles GET requests for the trials of the study id that
+// accept csv, responding with a csv file holding a row for each trial.
+// The trials are filtered and paginated as in a list (see listResources).
+// Trials whose data payload isn't an object are listed by name alone.
+func exportTrials(w http.ResponseWriter, r *http.Request, host string,
+	store Store, id string) {
+
+	p, err := pageParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, err := whereParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rows []map[string]string
+	next := "" // id of the last trial in the file, if more follow
+	parent := id + "/trials"
+	err = store.View(func(tx Tx) error {
+		listings, more, err := p.list(tx, parent, where)
+		if err != nil {
+			return err
+		}
+		if more {
+			next = listings[len(listings)-1].id
+		}
+
+		for _, l := range listings {
+			doc, err := decodeJSON(l.rec.Data)
+			if err != nil {
+				return fmt.Errorf("stored document is invalid: %v", err)
+			}
+			row := map[string]string{}
+			if _, ok := doc.(map[string]interface{}); ok {
+				values := map[string]string{}
+				flatten(values, "", doc)
+				for path, value := range values {
+					row[columnName(path)] = value
+				}
+			}
+			row[trialColumn] = l.id[len(parent)+1:]
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+
+	// The trial column comes first, followed by the others in order.
+	var header []string
+	seen := map[string]bool{trialColumn: true}
+	for _, row := range rows {
+		for column := range row {
+			if !seen[column] {
+				header = append(header, column)
+				seen[column] = true
+			}
+		}
+	}
+	sort.Strings(header)
+	header = append([]string{trialColumn}, header...)
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, column := range header {
+			record[i] = row[column]
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if next != "" {
+		setNext(w, r, host, next)
+	}
+	w.Header().Set("Content-Type", csvType+"; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// csvHeader checks the header of a csv file of trials, returning the
+// path of each column and the index of the trial column.
+func csvHeader(header []string) ([][]string, int, error) {
+	paths := make([][]string, len(header))
+	trial := -1
+	seen := map[string]bool{}
+	for i, column := range header {
+		if seen[column] {
+			return nil, 0, fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+		if column == trialColumn {
+			trial = i
+			continue
+		}
+		path, err := parsePath(columnPath(column))
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid column %q: %v", column, err)
+		}
+		paths[i] = path
+	}
+	if trial < 0 {
+		return nil, 0, fmt.Errorf("missing %q column", trialColumn)
+	}
+	// A column can't hold the value of another column, or a value within
+	// it.
+	for i, column := range header {
+		for j, other := range header {
+			if i == j || i == trial || j == trial {
+				continue
+			}
+			path, otherPath := columnPath(column), columnPath(other)
+			if path == otherPath || strings.HasPrefix(otherPath, path+".") {
+				return nil, 0, fmt.Errorf("column %q conflicts with "+
+					"column %q", other, column)
+			}
+		}
+	}
+	return paths, trial, nil
+}
+
+// importTrials handles POST requests sending a csv file of trials to the
+// study id, creating or updating a trial for each row.  The values in each
+// row replace those at the same paths in the trial's data payload, leaving
+// other values (and the values of empty cells) as they were; rows that
+// wouldn't change a trial are skipped.  Rows that can't be imported are
+// reported in the response, along with the number of trials created and
+// updated from the others.
+func importTrials(w http.ResponseWriter, r *http.Request, store Store,
+	id string) {
+
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		err = fmt.Errorf("missing header row")
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid csv: "+err.Error())
+		return
+	}
+	paths, trialIndex, err := csvHeader(header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid csv: "+err.Error())
+		return
+	}
+	var records [][]string
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest,
+				"invalid csv: "+err.Error())
+			return
+		}
+		records = append(records, record)
+	}
+
+	var report *ImportReport
+	err = store.Update(func(tx Tx) error {
+		report = &ImportReport{Study: id, Errors: []*RowError{}}
+		imported := map[string]int{} // rows importing each trial
+		for i, record := range records {
+			row := i + 2 // the header is on row 1
+			if len(record) != len(header) {
+				report.Errors = append(report.Errors, &RowError{
+					Row: row,
+					Detail: fmt.Sprintf("expecting %d cells, got %d",
+						len(header), len(record)),
+				})
+				continue
+			}
+			name := record[trialIndex]
+			rowErr := &RowError{Row: row, Trial: name}
+			if err := ValidateName(name); err != nil {
+				rowErr.Detail = err.Error()
+				report.Errors = append(report.Errors, rowErr)
+				continue
+			}
+			if prev, ok := imported[name]; ok {
+				rowErr.Detail = fmt.Sprintf("trial already imported on "+
+					"row %d", prev)
+				report.Errors = append(report.Errors, rowErr)
+				continue
+			}
+			imported[name] = row
+
+			trialID := id + "/trials/" + name
+			old, err := getRecord(tx, trialID)
+			if err != nil {
+				return err
+			}
+			var doc interface{} = map[string]interface{}{}
+			if old != nil {
+				if doc, err = decodeJSON(old.Data); err != nil {
+					return fmt.Errorf("stored document is invalid: %v", err)
+				}
+			}
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				rowErr.Detail = "the trial's data payload isn't an object"
+				report.Errors = append(report.Errors, rowErr)
+				continue
+			}
+			updated := deepCopy(obj).(map[string]interface{})
+			for j, text := range record {
+				if j == trialIndex {
+					continue
+				}
+				if v, ok := parseCell(text); ok {
+					putPath(updated, paths[j], v)
+				}
+			}
+			if old != nil && reflect.DeepEqual(obj, updated) {
+				report.Unchanged++
+				continue
+			}
+			data, err := json.Marshal(updated)
+			if err != nil {
+				return err
+			}
+			_, err = putRecord(tx, trialID, old, data, author(r))
+			if _, ok := err.(*dataError); ok {
+				rowErr.Detail = err.Error()
+				report.Errors = append(report.Errors, rowErr)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				report.Created++
+			} else {
+				report.Updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// putPath sets the value at path in the json object obj to v, replacing
+// any values along the path that aren't objects.
+func putPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := obj[name].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			obj[name] = next
+		}
+		obj = next
+	}
+	obj[path[len(path)-1]] = v
+}
@@ -0,0 +1,168 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An ImportReport models the summary of a csv import.
+type ImportReport struct {
+	Study     string `json:"study"`
+	Created   int    `json:"created"`
+	Updated   int    `json:"updated"`
+	Unchanged int    `json:"unchanged"`
+	Errors    []struct {
+		Row    int    `json:"row"`
+		Trial  string `json:"trial"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+// Ensure trials can be exported to and imported from csv files.
+func TestCSV(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for path, doc := range map[string]string{
+		"/studies/a/trials/t2": `{"subject":{"name":"rat_3","age":4},` +
+			`"done":true,"tags":["x"],"note":"a, \"b\""}`,
+		"/studies/a/trials/t10": `{"subject":{"name":"rat_10"},"n":null}`,
+		"/studies/a/trials/t3":  `[1,2]`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	header := map[string]string{"Accept": "text/csv"}
+	url := srv.addr + "/studies/a/trials?sort=natural"
+	res := sendWith(t, "GET", url, header, nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if want, got := "text/csv; charset=utf-8",
+		res.Header.Get("Content-Type"); want != got {
+		t.Errorf("want content type %s, got %s", want, got)
+	}
+	want := "trial,done,n,note,subject.age,subject.name,tags\n" +
+		"t2,true,,\"a, \"\"b\"\"\",4,rat_3,\"[\"\"x\"\"]\"\n" +
+		"t3,,,,,,\n" +
+		"t10,,null,,,rat_10,\n"
+	if got := string(body); want != got {
+		t.Errorf("want csv\n%s\ngot\n%s", want, got)
+	}
+
+	// Rows update the values in their columns, leaving others as they were.
+	csv := "trial,subject.age,done,tags\n" +
+		"t2,5,true,\"[\"\"x\"\"]\"\n" + // updated
+		"t10,,,\n" + // unchanged
+		"t11,1,false,\n" + // created
+		"t3,1,,\n" + // not an object
+		"files,1,,\n" + // reserved name
+		"t11,2,,\n" + // imported twice
+		"t12,1\n" // too short
+	header = map[string]string{"Content-Type": "text/csv"}
+	res = sendWith(t, "POST", srv.addr+"/studies/a/trials", header,
+		strings.NewReader(csv))
+	var report ImportReport
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+	if report.Study != "/studies/a" || report.Created != 1 ||
+		report.Updated != 1 || report.Unchanged != 1 {
+		t.Errorf("want 1 trial created, updated, and unchanged, got %+v",
+			report)
+	}
+	var rows []int
+	for _, e := range report.Errors {
+		rows = append(rows, e.Row)
+	}
+	if want := []int{5, 6, 7, 8}; !reflect.DeepEqual(want, rows) {
+		t.Errorf("want errors on rows %v, got %+v", want, report.Errors)
+	}
+
+	for path, want := range map[string]string{
+		"/studies/a/trials/t2": `{"done":true,"note":"a, \"b\"",` +
+			`"subject":{"age":5,"name":"rat_3"},"tags":["x"]}`,
+		"/studies/a/trials/t11": `{"done":false,"subject":{"age":1}}`,
+	} {
+		got, _ := json.Marshal(getDocument(t, srv.addr+path))
+		if want != string(got) {
+			t.Errorf("GET %s: want %s, got %s", path, want, got)
+		}
+	}
+
+	// Strings that would be parsed as json are quoted, so that they're
+	// imported as they were exported.
+	doc := `{"e":"","n":"4","q":"\"x\"","s":"x","t":"true"}`
+	res = send(t, "PUT", srv.addr+"/studies/c/trials/t1",
+		strings.NewReader(doc))
+	res.Body.Close()
+	res = sendWith(t, "GET", srv.addr+"/studies/c/trials",
+		map[string]string{"Accept": "text/csv"}, nil)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	want = "trial,e,n,q,s,t\n" +
+		`t1,"""""","""4""","""\""x\""""",x,"""true"""` + "\n"
+	if got := string(body); want != got {
+		t.Errorf("want csv\n%s\ngot\n%s", want, got)
+	}
+	res = sendWith(t, "POST", srv.addr+"/studies/c/trials", header,
+		strings.NewReader(string(body)))
+	report = ImportReport{}
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	res.Body.Close()
+	if report.Unchanged != 1 || len(report.Errors) != 0 {
+		t.Errorf("want trial unchanged by its export, got %+v", report)
+	}
+
+	// Values within data members named like the trial column (or "data")
+	// are headed by their full paths.
+	doc = `{"data":{"trial":2},"n":3,"trial":1}`
+	res = send(t, "PUT", srv.addr+"/studies/b/trials/t1",
+		strings.NewReader(doc))
+	res.Body.Close()
+	res = sendWith(t, "GET", srv.addr+"/studies/b/trials",
+		map[string]string{"Accept": "text/csv"}, nil)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	want = "trial,data.data.trial,data.trial,n\nt1,2,1,3\n"
+	if got := string(body); want != got {
+		t.Errorf("want csv\n%s\ngot\n%s", want, got)
+	}
+	res = sendWith(t, "POST", srv.addr+"/studies/b/trials", header,
+		strings.NewReader(string(body)))
+	report = ImportReport{}
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	res.Body.Close()
+	if report.Unchanged != 1 || len(report.Errors) != 0 {
+		t.Errorf("want trial unchanged by its export, got %+v", report)
+	}
+
+	for _, csv := range []string{
+		"",
+		"subject,age\nt1,4\n",
+		"trial,age,age\nt1,4,5\n",
+		"trial,subject,subject.age\nt1,x,4\n",
+		"trial,age,data.age\nt1,4,5\n",
+		"trial,a..b\nt1,4\n",
+		"trial,age\n\"t1,4\n",
+	} {
+		res := sendWith(t, "POST", srv.addr+"/studies/a/trials", header,
+			strings.NewReader(csv))
+		res.Body.Close()
+		if want, got := http.StatusBadRequest, res.StatusCode; want != got {
+			t.Errorf("import %q: want %d, got %d", csv, want, got)
+		}
+	}
+}
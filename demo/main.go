@@ -8,7 +8,6 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
-	// "os"
 	"time"
 
 	"github.com/joyrexus/xhub"
@@ -18,19 +17,21 @@ const verbose = false // if `true` you'll see log output
 
 func main() {
 	// Create a new xhub server.
+	//
+	// Normally we'd persist study data in a database file with
+	// `xhub.NewServer(addr, dbfile)`, but for the demo an in-memory
+	// store will do: nothing is left behind once the demo exits.
 	addr := "127.0.0.1:8081" // server address to use
-	dbfile := "xhub.db"   // path to file to use for persisting study data
-	srv := xhub.NewServer(addr, dbfile)
+	srv := xhub.NewServerWithStore(addr, xhub.NewMemStore())
 
 	// Run our server as an http test server.
 	//
 	// Normally we'd start the server with `srv.ListenAndServe()`,
 	// but running as a test server let's us shut down the server
-	// and remove the database file afterward.
+	// afterward.
 	testsrv := httptest.NewServer(srv)
 	defer srv.Close()
 	defer testsrv.Close()
-	// defer os.Remove(dbfile)
 
 	// Setup study resources for our client to post.
 	var studies []*Resource
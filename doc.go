@@ -37,7 +37,49 @@ The primary unit of organization is the study. A study can contain trials or "st
         STUDY_N
             ...
 
-Clients are expected to send resource representations via http POST requests with json-encoded payloads.  Clients can issue http GET requests for a list of resources (e.g., trials associated with a particular study) or a specific resource (e.g., a particular trial), where the http response will in turn be a json-encoded payload to be handled by the client.
+Each resource is identified by its path in this hierarchy, e.g., `/studies/STUDY_A/trials/TRIAL_1` for a trial (trial-level files are identified as `/files/STUDY/TRIAL/FILE`).  The name of a study, trial, or file (the last segment of its id) must be between 1 and 128 characters long and may only contain letters, digits, combining marks, and the characters ".", "_", and "-".  Letters and digits may come from any script, but names must be in Unicode normalization form C (NFC).  The names ".", "..", "files", and "trials" are reserved.  Resources with invalid names are rejected when posted, with a response explaining the problem.
+
+Clients are expected to send resource representations via http POST requests with json-encoded payloads.  Clients can issue http GET requests for a list of resources (e.g., trials associated with a particular study) or a specific resource (e.g., a particular trial), where the http response will in turn be a json-encoded payload to be handled by the client.  A specific resource's data payload can be replaced with an http PUT request sending the new json document, or updated in place with an http PATCH request sending either a JSON Merge Patch (RFC 7386, content type `application/merge-patch+json`) or a JSON Patch (RFC 6902, content type `application/json-patch+json`).
+
+Along with its data payload, the service records when each resource was created and last modified, and by whom.  The submitting user is taken from the user name given with basic authentication, the From header, or (failing those) the User-Agent header; none of these are verified.  This metadata is included with each resource listed, and a specific resource is returned along with its metadata (as in a list) when requested with the `envelope=true` query parameter.
+
+To spare clients a request per resource when rendering a study, the ids of a resource's children (the trials and study-level files of a study, or the files of a trial) can be included with it via the `expand=children` query parameter, on both list and single-resource GET requests.  The `depth=N` parameter instead includes descendants down to N levels, each resource's children following its own id; `expand=children` is the same as `depth=1`.  A specific resource requested this way is returned in an envelope.
+
+Lists of resources can be sorted and paginated with query parameters.  The `sort` parameter orders resources by `id` (the default), by `created` time, or in `natural` order, where numbers within ids are compared by value (so that `trial_2` sorts before `trial_10`).  The `limit` parameter caps the number of resources listed, in which case the response carries a Link header referring to the next page, if any.  Pages are requested with the `after` parameter, giving the id of the last resource on the previous page; clients should simply follow the Link headers.
+
+Lists can also be filtered by the data payloads of their resources, with one or more `where` query parameters of the form `data.PATH OP VALUE`, where PATH is a dot-separated path of member names or array indices and OP is one of `=`, `!=`, `<`, `<=`, `>`, or `>=` (e.g., `/studies/STUDY_A/trials?where=data.subject=rat_3&where=data.weight>10`).  Only resources meeting every condition are listed.  Values are compared according to their type: numbers numerically, RFC 3339 dates and times (e.g., `2018-01-05` or `2018-01-05T12:00:00Z`) chronologically, and other strings lexically, while booleans and null can only be tested for (in)equality.  A condition on a missing value, or a value that can't be compared with the one given, is only met by `!=`.
+
+Filtering a list examines each resource in it.  For faster lookups across all studies, paths within the data payloads of each resource type can be indexed (see xhub-index and Server.Reindex).  A GET request for `/lookup?path=PATH&value=VALUE` (e.g., `/lookup?path=data.subject&value=rat_3`) then lists the resources whose value at the indexed path PATH is VALUE, compared as in `where` parameters, or, for array values, holds VALUE as an element.  The `min` and `max` parameters instead give an inclusive range of numbers, dates, or strings, either of which may be omitted, and the `resource` parameter restricts a lookup to resources of one type.  Indexes are updated along with the resources they index, in the same transaction.
+
+A GET request for `/search?q=WORDS` searches the text of all resources for any of the given words, ignoring case: the name and description of each study, and every string value within the data payload of each trial and file.  Hits are listed best first, ranked by how many of the words they contain and how often, with words occurring in fewer resources counting for more.  Each hit is a resource along with its relevance score, the path of its best-matching text (e.g., `data.desc`) and a snippet of that text, and the ids of the study and trial it belongs to.  The `limit` parameter caps the number of hits listed.
+
+To keep responses small, GET requests for resources, lists of resources, and trees can ask for particular fields with the `fields` query parameter, a comma-separated list of field names (e.g., `id` or `created`) and paths within the data payload (e.g., `data.subject`), as in `/studies/STUDY_A/files?fields=id,created,data.subject`.  Each resource is reduced to the fields requested, with data payloads reduced to the paths requested and the objects leading to them.  A specific resource requested this way is returned in an envelope.
+
+Clients sending an `Accept: application/x-ndjson` header with a GET request for the trials or files of a study (or the files of a trial) receive a stream of newline-delimited json instead of a list: each resource is sent on a line of its own as soon as it's read from the store, so that large collections can be exported without being held in memory by either side.  Streamed resources can be filtered, expanded, and reduced to particular fields like listed ones, but are always ordered by id and can't be limited; an interrupted stream can be resumed with the `after` parameter.  If the server fails partway through a stream, it aborts the response rather than ending it cleanly.
+
+The trials of a study can also be exchanged as csv files, for the sake of spreadsheets.  A GET request for `/studies/STUDY/trials` accepting `text/csv` returns a csv file with a row for each trial: the first column, headed `trial`, holds the trial's name, and the others hold the values within its data payload, headed by their dotted paths (e.g., `subject.name`).  Strings are written as they are and other values as json, except that strings that would be read back as json (e.g., `true`) are written as json strings, in quotes.  Values within a member named `trial` or `data` are headed by their full paths (e.g., `data.trial`), so as not to clash with the trial column; a column headed this way is imported at the path it names.  The rows can be filtered, sorted, and paginated like a list.  Conversely, a POST request sending a csv file (content type `text/csv`) to `/studies/STUDY/trials` creates or updates the trial named on each row, setting the values at the paths of the columns to those of its cells: cells holding json are decoded as such (so a cell holding a quoted json string holds the string without its quotes), while other cells hold strings and empty cells are skipped.  Values in the trial's data payload without a column are left as they were.  The response reports how many trials were created or updated, along with any rows that couldn't be imported and why; the other rows are imported regardless.
+
+Many changes can be made at once with a POST request for `/batch`, sending a json array of operations, each an object with an "op" of `create`, `update`, or `delete` and the "id" of a study, trial, or file (e.g., `{"op":"create","id":"/files/STUDY/TRIAL/FILE","data":{...}}`).  Creating or updating a resource sets its "data" payload; creating one that exists fails with 409 Conflict, while updating or deleting one that doesn't fails with 404 Not Found.  An operation carrying an "etag" only applies to that revision of the resource, as with If-Match.  The operations are applied in order in a single transaction, and the response lists the result of each: its http "status", along with the new "etag" of a resource written, a summary of the resources "deleted", or the "detail" of a failure.  Operations that fail are skipped, while the others are applied regardless, unless the batch is requested with the `atomic=true` query parameter: then the first failure rolls back the whole batch, the response carries the failed operation's status, and the other operations report 424 Failed Dependency.
+
+Clients can safely retry POST requests (say, after a network timeout) by sending an `Idempotency-Key` header with a key of their choosing, unique to each request (e.g., a random UUID).  The response to the first request carrying a key is kept, and a later request carrying the same key receives that response again, marked with an `Idempotent-Replayed: true` header, rather than being handled anew.  A key reused for a different request (with a different url or body) is rejected with 422 Unprocessable Entity, and a request carrying a key in use by a request still being handled (or by one whose response couldn't be kept) is rejected with 409 Conflict, so that no request is ever handled twice.  Responses are kept for a configurable window (see xhub-serve), a day by default; failed requests answered with a 5xx status aren't kept, so that they can be retried.
+
+A study can carry a JSON Schema for the data payloads of its trials and another for those of its files, attached with a PUT request for `/studies/STUDY/schemas/trial` or `/studies/STUDY/schemas/file` sending the schema, retrieved with a GET request, and detached with a DELETE request.  Schemas are interpreted according to a subset of JSON Schema: the type, enum, const, properties, required, additionalProperties, items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, and not keywords, along with annotations such as title and description; schemas using other keywords (e.g., `$ref`) are rejected with 422 Unprocessable Entity.  Once a schema is attached, every write of a trial or file in the study (by POST, PUT, PATCH, revert, batch, or csv import) is checked against it, and a data payload that doesn't match is rejected with 422 Unprocessable Entity, listing each violation under "violations" by its path (e.g., `data.subject.age`) and the problem with it.  Existing resources aren't checked when a schema is attached, but the response to the PUT request reports those that fail it, as does a later GET request for the schema's url followed by `/report`.  A POST request for the schema's url followed by `/validate` checks the data payload sent without storing anything, responding with whether it's "valid" and its "violations", if any.  Schemas are deleted and restored along with their study.
+
+Trials of a study often share the same values (the rig or camera used, say).  A study can carry a trial template, set with a PUT request for `/studies/STUDY/template` sending an object with "defaults", an object holding the shared values, and "required", a list of dotted paths (e.g., `camera.model`) at which every trial must hold a value; the template is retrieved with a GET request and removed with a DELETE request.  The defaults are merged under the data payload of each trial written to the study, whether by POST, PUT, PATCH, revert, batch, or csv import: objects are merged member by member, and values given by the trial take precedence.  A trial lacking a required value once merged is rejected with 422 Unprocessable Entity, listing the missing paths under "violations", as is a trial whose data payload isn't an object.  A GET request for a trial with the `resolved=true` query parameter returns the trial in an envelope, with the study's current template merged under its data payload, along with a "template" object flagging the path of each default (e.g., `data.camera.model`) as "inherited" if the trial took its value from the template, or "overridden" if the value was sent for the trial (even if it equals the default).  Inherited values stay inherited until a write changes them, and resolve to the template's current defaults as the template changes.  Templates are deleted and restored along with their study.
+
+The whole hierarchy of a study can also be retrieved as a single nested json document, via a GET request for `/studies/STUDY/tree`.  The document is the study resource (including its data payload) with its study-level files and trials listed under "files" and "trials", each trial in turn listing its files under "files".
+
+Deleting a resource deletes all resources it contains: deleting a study deletes its trials and files, and deleting a trial deletes its files.  Each delete happens in a single transaction, so a failure leaves everything in place.  The response to a DELETE request summarizes how many trials and files were deleted, e.g. `{"id":"/studies/STUDY_A","trials":2,"files":5}`.
+
+Deleted resources aren't destroyed right away, but moved to a trash, along with the time they were deleted and by whom.  A GET request for `/trash` lists the deleted resources, and a POST request for `/trash/ID/restore` (e.g., `/trash/studies/STUDY_A/restore`) restores the resource ID along with everything deleted with it.  A resource can only be restored if its parent exists (a trial's study, say) and none of the resources deleted with it have been recreated in the meantime; otherwise, the request fails with 409 Conflict.  Servers purge resources from the trash once they've been deleted for longer than a retention period (see xhub-serve).
+
+Every revision of a resource is kept in its history.  A GET request for the resource's url followed by `/history` (e.g., `/studies/STUDY_A/trials/TRIAL_1/history`) lists its revisions, oldest first, each with the time it was written, the user who wrote it, and the size of its data payload.  A GET request for `/history/REV` returns the data payload of revision REV, in an envelope if requested.  The history of a deleted resource is kept until it's purged from the trash, and a resource recreated after being deleted carries on its revision numbers where its history left off.
+
+Revisions can be compared with a GET request for the resource's url followed by `/diff?from=REV&to=REV`, which returns a JSON Patch (RFC 6902) transforming the data payload of the first revision into that of the second; if `to` is omitted, the current revision is used.  A POST request for the resource's url followed by `/revert?rev=REV` restores the data payload of revision REV as a new revision, honoring If-Match like PUT.
+
+Each stored resource carries a revision number, incremented whenever its data payload is written.  The revision is sent as the resource's ETag on responses to GET, POST, PUT, and PATCH requests (and as the "etag" field of each listed resource), while lists of resources are tagged with a weak ETag reflecting their contents.  Clients can avoid overwriting each other's changes by sending the ETag they last saw in the If-Match header of POST, PUT, PATCH, and DELETE requests: if the resource has been changed since, the request fails with 412 Precondition Failed.  Likewise, a GET request sending an If-None-Match header that matches the current ETag receives 304 Not Modified.
+
+Requests that can't be fulfilled receive a json-encoded "problem details" response (see RFC 7807) with a content type of `application/problem+json`.  The response status indicates the kind of problem: 400 for malformed requests (e.g., invalid json), 404 for missing resources, 409 for requests that conflict with the current state of a resource, 412 for requests whose If-Match precondition fails, 422 for resource representations that are well-formed but invalid (e.g., posted to the wrong endpoint), and 500 for storage failures.  For the sake of older xpub clients, a server can be configured to respond to requests for missing resources with 204 No Content instead.
 
 TODO: Provide an overview of required/optional fields for incoming resource representations.  For now, see the Resource type used to handle POST requests.
 */
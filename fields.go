@@ -0,0 +1,124 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A projection lists the fields of resources requested by the fields query
+// parameter (e.g., `fields=id,created,data.subject`), each as a path of
+// member names.
+type projection [][]string
+
+// resourceFields lists the names of the fields of a json-encoded Resource.
+var resourceFields = map[string]bool{
+	"version":  true,
+	"resource": true,
+	"id":       true,
+	"url":      true,
+	"data":     true,
+	"created":  true,
+	"modified": true,
+	"author":   true,
+	"editor":   true,
+	"children": true,
+	"etag":     true,
+}
+
+// fieldsParam returns the projection requested by the fields parameter of
+// r, a comma-separated list of the names of Resource fields and of paths
+// within the data payload of the form `data.PATH`, as in where parameters.
+// The projection is nil if the parameter is absent.
+func fieldsParam(r *http.Request) (projection, error) {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	var p projection
+	for _, field := range strings.Split(v, ",") {
+		name := field
+		if i := strings.Index(field, "."); i >= 0 {
+			name = field[:i]
+		}
+		if !resourceFields[name] {
+			return nil, fmt.Errorf("invalid fields parameter %q: unknown "+
+				"field %q", v, name)
+		}
+		if name != field {
+			path, err := parsePath(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fields parameter %q: %v",
+					v, err)
+			}
+			p = append(p, append([]string{"data"}, path...))
+			continue
+		}
+		p = append(p, []string{name})
+	}
+	return p, nil
+}
+
+// apply returns the json document encoding v, a resource or a list or tree
+// of resources, with each resource reduced to the fields of the projection.
+// The files and trials of each resource in a tree are kept.  A nil
+// projection leaves v as it is.
+func (p projection) apply(v interface{}) (interface{}, error) {
+	if p == nil {
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return p.project(doc), nil
+}
+
+// project reduces each resource in the decoded json document doc to the
+// fields of the projection.
+func (p projection) project(doc interface{}) interface{} {
+	switch x := doc.(type) {
+	case []interface{}:
+		for i, elem := range x {
+			x[i] = p.project(elem)
+		}
+		return x
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for _, path := range p {
+			if v, ok := lookup(x, path); ok {
+				setPath(out, path, v)
+			}
+		}
+		for _, name := range []string{"files", "trials"} {
+			if children, ok := x[name]; ok {
+				out[name] = p.project(children)
+			}
+		}
+		return out
+	}
+	return doc
+}
+
+// setPath sets the value at path in the json object obj to v, adding any
+// objects along the path that are missing.  Nothing is set if obj already
+// holds a value other than an object along the path, which then includes
+// v (e.g., an array holding the element at path).
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := obj[name]
+		if !ok {
+			next = map[string]interface{}{}
+			obj[name] = next
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return
+		}
+	}
+	obj[path[len(path)-1]] = v
+}
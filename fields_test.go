@@ -0,0 +1,74 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Ensure resources can be reduced to the fields requested.
+func TestFields(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for path, doc := range map[string]string{
+		"/studies/a": `{"name":"A"}`,
+		"/studies/a/trials/t1": `{"subject":{"name":"rat_3","age":4},` +
+			`"tags":["x","y"],"big":"..."}`,
+		"/studies/a/trials/t2": `{"subject":"rat_10"}`,
+		"/files/a/t1/f1":       `{"format":"csv","big":"..."}`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/studies/a/trials?fields=id", `[{"id":"/studies/a/trials/t1"},` +
+			`{"id":"/studies/a/trials/t2"}]`},
+		{"/studies/a/trials?fields=id,data.subject.name", `[` +
+			`{"data":{"subject":{"name":"rat_3"}},"id":"/studies/a/trials/t1"},` +
+			`{"id":"/studies/a/trials/t2"}]`},
+		{"/studies/a/trials?fields=data.tags,data.tags.0&limit=1",
+			`[{"data":{"tags":["x","y"]}}]`},
+		{"/studies?fields=id,children&expand=children",
+			`[{"children":["/studies/a/trials/t1","/studies/a/trials/t2"],` +
+				`"id":"/studies/a"}]`},
+		// Requesting fields of a single resource implies an envelope.
+		{"/studies/a/trials/t1?fields=resource,data.subject.age",
+			`{"data":{"subject":{"age":4}},"resource":"trial"}`},
+		{"/files/a/t1/f1?fields=data.format",
+			`{"data":{"format":"csv"}}`},
+		{"/files/a/t1/f1/history/1?fields=etag", `{"etag":"\"1\""}`},
+		{"/studies/a/tree?fields=id", `{"id":"/studies/a","trials":[` +
+			`{"files":[{"id":"/files/a/t1/f1"}],"id":"/studies/a/trials/t1"},` +
+			`{"id":"/studies/a/trials/t2"}]}`},
+	} {
+		res := send(t, "GET", srv.addr+tt.path, nil)
+		var got interface{}
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatalf("error decoding %s: %v", tt.path, err)
+		}
+		res.Body.Close()
+		data, _ := json.Marshal(got)
+		if string(data) != tt.want {
+			t.Errorf("GET %s:\nwant %s\ngot  %s", tt.path, tt.want, data)
+		}
+	}
+
+	for _, path := range []string{
+		"/studies/a/trials?fields=name",
+		"/studies/a/trials?fields=id,",
+		"/studies/a/trials/t1?fields=id.x",
+		"/studies/a/trials/t1?fields=data..x",
+		"/studies/a/tree?fields=size",
+	} {
+		if want, got := http.StatusBadRequest,
+			status(t, "GET", srv.addr+path); want != got {
+			t.Errorf("GET %s: want %d, got %d", path, want, got)
+		}
+	}
+}
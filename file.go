@@ -1,50 +1,32 @@
 package xhub
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
-	"github.com/joyrexus/buckets"
 	"github.com/julienschmidt/httprouter"
 )
 
 // NewFileController initializes a new instance of our trial controller.
-func NewFileController(host string, bux *buckets.DB) *FileController {
-	// Create/open bucket for storing study-related data.
-	studies, err := bux.New([]byte("studies"))
-	if err != nil {
-		log.Fatalf("couldn't create/open studies bucket: %v\n", err)
-	}
-	return &FileController{host, studies}
+func NewFileController(host string, store Store,
+	config *Config) *FileController {
+
+	return &FileController{host, store, config}
 }
 
 // A FileController handles requests for file resources.
 type FileController struct {
-	host    string
-	studies *buckets.Bucket
+	host   string
+	store  Store
+	config *Config
 }
 
 // Post handles POST requests for `/studies/:study/files` and
 // `/files/:study/:trial`, storing the file data sent.
 func (c *FileController) Post(w http.ResponseWriter, r *http.Request,
-	_ httprouter.Params) {
+	p httprouter.Params) {
 
-	var file Resource
-	err := json.NewDecoder(r.Body).Decode(&file)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	// TODO: validate file id format
-	// Use file id as key when storing file data as value.
-	key := []byte(file.ID)
-	if err := c.studies.Put(key, file.Data); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	w.WriteHeader(http.StatusCreated)
+	postResource(w, r, c.store, "file", fileParent(p), nil)
 }
 
 // List handles GET requests for `/studies/:study/files` and
@@ -53,35 +35,7 @@ func (c *FileController) Post(w http.ResponseWriter, r *http.Request,
 func (c *FileController) List(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
-	study, trial := p.ByName("study"), p.ByName("trial")
-	prefix := fmt.Sprintf("/studies/%s/files", study)
-	if trial != "" {
-		prefix = fmt.Sprintf("/files/%s/%s", study, trial)
-	}
-	items, err := c.studies.PrefixItems([]byte(prefix))
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	resources := []*Resource{}
-
-	// Append each item to the list of resources.
-	for _, file := range items {
-		id := string(file.Key)
-		url := "http://" + c.host + id
-		rsc := &Resource{
-			Version: "1",
-			Type:    "file",
-			ID:      id,
-			URL:     url,
-			Data:    file.Value,
-		}
-		resources = append(resources, rsc)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resources)
+	listResources(w, r, c.host, c.store, "file", fileParent(p))
 }
 
 // Get handles GET requests for `/studies/:study/files/:file` and
@@ -90,49 +44,92 @@ func (c *FileController) List(w http.ResponseWriter, r *http.Request,
 func (c *FileController) Get(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
-	study, file := p.ByName("study"), p.ByName("file")
-	id := fmt.Sprintf("/studies/%s/files/%s", study, file)
+	getResource(w, r, c.host, c.store, c.config, "file", fileID(p))
+}
 
-	// If trial parameter specified, then a trial-level file was requested.
-	trial := p.ByName("trial")
-	if trial != "" {
-		id = fmt.Sprintf("/files/%s/%s/%s", study, trial, file)
-	}
+// Put handles PUT requests for `/studies/:study/files/:file` and
+// `/files/:study/:trial/:file`, replacing the json data payload of the
+// requested file with the json document sent.  The file is created if it
+// doesn't exist yet.
+func (c *FileController) Put(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
 
-	data, err := c.studies.Get([]byte(id))
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	if data == nil {
-		http.Error(w, id+" not found", http.StatusNoContent)
+	if err := ValidateName(p.ByName("file")); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
+	putResource(w, r, c.store, fileID(p), nil)
+}
+
+// Patch handles PATCH requests for `/studies/:study/files/:file` and
+// `/files/:study/:trial/:file`, applying the patch document sent (either a
+// json merge patch or a json patch) to the json data payload of the
+// requested file.
+func (c *FileController) Patch(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	patchResource(w, r, c.store, fileID(p))
 }
 
 // Delete handles DELETE requests for `/studies/:study/files/:file` and
-// `/files/:study/:trial/:file`.
+// `/files/:study/:trial/:file`, moving the requested file to the trash.
 func (c *FileController) Delete(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
-	study, file := p.ByName("study"), p.ByName("file")
-	id := fmt.Sprintf("/studies/%s/files/%s", study, file)
+	id := fileID(p)
+	deleteResources(w, r, c.store, c.config, id, trashRoots(id))
+}
 
-	// If trial parameter specified, then a trial-level file was requested.
-	trial := p.ByName("trial")
-	if trial != "" {
-		id = fmt.Sprintf("/files/%s/%s/%s", study, trial, file)
-	}
+// History handles GET requests for `/studies/:study/files/:file/history`
+// and `/files/:study/:trial/:file/history`, returning a list of the
+// revisions of the requested file.
+func (c *FileController) History(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
 
-	err := c.studies.Delete([]byte(id))
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	listHistory(w, r, c.host, c.store, c.config, fileID(p))
+}
+
+// Revision handles GET requests for
+// `/studies/:study/files/:file/history/:rev` and
+// `/files/:study/:trial/:file/history/:rev`, returning the raw json data
+// payload of the requested revision of the file.
+func (c *FileController) Revision(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	getHistory(w, r, c.host, c.store, c.config, "file", fileID(p),
+		p.ByName("rev"))
+}
+
+// Diff handles GET requests for `/studies/:study/files/:file/diff` and
+// `/files/:study/:trial/:file/diff`, returning a json patch between the
+// revisions of the requested file given by the from and to parameters.
+func (c *FileController) Diff(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	diffHistory(w, r, c.store, fileID(p))
+}
+
+// Revert handles POST requests for `/studies/:study/files/:file/revert`
+// and `/files/:study/:trial/:file/revert`, restoring the revision of the
+// requested file given by the rev parameter as a new revision.
+func (c *FileController) Revert(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	revertResource(w, r, c.store, fileID(p))
+}
+
+// fileParent returns the id of the collection holding the files of the
+// study (or, if a trial parameter is specified, the trial) requested.
+func fileParent(p httprouter.Params) string {
+	study, trial := p.ByName("study"), p.ByName("trial")
+	if trial != "" {
+		return fmt.Sprintf("/files/%s/%s", study, trial)
 	}
+	return fmt.Sprintf("/studies/%s/files", study)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+// fileID returns the id of the file requested.  If a trial parameter is
+// specified, then a trial-level file was requested.
+func fileID(p httprouter.Params) string {
+	return fileParent(p) + "/" + p.ByName("file")
 }
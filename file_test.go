@@ -49,8 +49,8 @@ func TestFileMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 
@@ -71,8 +71,8 @@ func TestFileMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// No harm done.
-	if want, got := http.StatusOK, res.StatusCode; want != got {
+	// Missing resources can't be deleted.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -131,7 +131,7 @@ func TestFilePersistence(t *testing.T) {
 	// Create a file resource to be posted.
 	file := &Resource{
 		Version: "1",
-		Type:    "fie",
+		Type:    "file",
 		ID:      "/studies/test_study/files/test_file",
 		Data:    fileData,
 		Created: time.Now(),
@@ -182,7 +182,7 @@ func TestFilePersistence(t *testing.T) {
 	// Check expected URL of the one posted file resource.
 	fileURL := "http://localhost:8081/studies/test_study/files/test_file"
 	if want, got := fileURL, items[0].URL; want != got {
-		t.Errorf("want %d item, got %d", want, got)
+		t.Errorf("want %s, got %s", want, got)
 	}
 
 	// -- GET -- //
@@ -239,8 +239,8 @@ func TestFilePersistence(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -286,8 +286,8 @@ func TestTrialFileMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 
@@ -308,8 +308,8 @@ func TestTrialFileMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// No harm done.
-	if want, got := http.StatusOK, res.StatusCode; want != got {
+	// Missing resources can't be deleted.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -368,7 +368,7 @@ func TestTrialFilePersistence(t *testing.T) {
 	// Create a trial-level file resource to be posted.
 	file := &Resource{
 		Version: "1",
-		Type:    "fie",
+		Type:    "file",
 		ID:      "/files/test_study/test_trial/test_file",
 		Data:    fileData,
 		Created: time.Now(),
@@ -419,7 +419,7 @@ func TestTrialFilePersistence(t *testing.T) {
 	// Check expected URL of the one posted file resource.
 	fileURL := "http://localhost:8081/files/test_study/test_trial/test_file"
 	if want, got := fileURL, items[0].URL; want != got {
-		t.Errorf("want %d item, got %d", want, got)
+		t.Errorf("want %s, got %s", want, got)
 	}
 
 	// -- GET -- //
@@ -476,8 +476,8 @@ func TestTrialFilePersistence(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
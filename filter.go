@@ -0,0 +1,227 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A condition is a comparison of the value at a path in the data payload
+// of a resource with an operand, as given by a where query parameter
+// (e.g., `where=data.subject=rat_3`).
+type condition struct {
+	path    []string // path of member names or array indices within data
+	op      string   // "=", "!=", "<", "<=", ">", or ">="
+	operand string
+}
+
+// A filter is a list of conditions, all of which a resource must meet.
+type filter []*condition
+
+// operators lists the comparison operators of conditions, longest first
+// so that they're recognized in full.
+var operators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// whereParam returns the filter given by the where query parameters of r.
+// Each parameter is a condition of the form `data.PATH OP VALUE` (without
+// spaces), where PATH is a dot-separated path of member names or array
+// indices within a resource's data payload.
+func whereParam(r *http.Request) (filter, error) {
+	var f filter
+	for _, v := range r.URL.Query()["where"] {
+		c, err := parseCondition(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid where parameter %q: %v", v, err)
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+// parseCondition parses the condition s.
+func parseCondition(s string) (*condition, error) {
+	i := strings.IndexAny(s, "!<>=")
+	if i < 0 {
+		return nil, fmt.Errorf("missing comparison operator")
+	}
+	c := &condition{}
+	for _, op := range operators {
+		if strings.HasPrefix(s[i:], op) {
+			c.op, c.operand = op, s[i+len(op):]
+			break
+		}
+	}
+	if c.op == "" {
+		return nil, fmt.Errorf("unknown comparison operator")
+	}
+	path, err := parsePath(s[:i])
+	if err != nil {
+		return nil, err
+	}
+	c.path = path
+	return c, nil
+}
+
+// parsePath parses a path of the form `data.PATH`, returning the member
+// names or array indices of PATH.
+func parsePath(s string) ([]string, error) {
+	path := strings.Split(s, ".")
+	if len(path) < 2 || path[0] != "data" {
+		return nil, fmt.Errorf("path must begin with \"data.\"")
+	}
+	for _, name := range path[1:] {
+		if name == "" {
+			return nil, fmt.Errorf("empty path segment")
+		}
+	}
+	return path[1:], nil
+}
+
+// match reports whether the data payload of rec meets all conditions of
+// the filter.
+func (f filter) match(rec *record) (bool, error) {
+	if len(f) == 0 {
+		return true, nil
+	}
+	doc, err := decodeJSON(rec.Data)
+	if err != nil {
+		return false, fmt.Errorf("stored document is invalid: %v", err)
+	}
+	for _, c := range f {
+		if !c.match(doc) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// match reports whether the decoded json document doc meets the condition.
+// Values are compared according to their type: numbers numerically,
+// strings holding RFC 3339 dates or times chronologically, and other
+// strings lexically.  Booleans and null can only be tested for equality.
+// A condition on a missing value, or on a value of a different type than
+// the operand, is only met by the != operator.
+func (c *condition) match(doc interface{}) bool {
+	v, ok := lookup(doc, c.path)
+	if !ok {
+		return c.op == "!="
+	}
+	switch v.(type) {
+	case bool, nil:
+		if c.op != "=" && c.op != "!=" {
+			return false
+		}
+	}
+	cmp, ok := compare(v, c.operand)
+	if !ok {
+		return c.op == "!="
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// lookup returns the value at path in the decoded json document doc,
+// reporting whether it exists.
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[name]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// compare compares the decoded json value v with the operand of a
+// condition, returning -1, 0, or 1 as v is less than, equal to, or greater
+// than the operand.  It reports false if they can't be compared.
+func compare(v interface{}, operand string) (int, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		a, err := x.Float64()
+		b, err2 := strconv.ParseFloat(operand, 64)
+		if err != nil || err2 != nil {
+			return 0, false
+		}
+		return compareFloats(a, b), true
+	case string:
+		if a, ok := parseTime(x); ok {
+			if b, ok := parseTime(operand); ok {
+				switch {
+				case a.Before(b):
+					return -1, true
+				case a.After(b):
+					return 1, true
+				}
+				return 0, true
+			}
+		}
+		return strings.Compare(x, operand), true
+	case bool:
+		b, err := strconv.ParseBool(operand)
+		if err != nil || x != b {
+			return 1, err == nil
+		}
+		return 0, true
+	case nil:
+		if operand != "null" {
+			return 0, false
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareFloats compares the numbers a and b.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// timeLayouts lists the layouts of the RFC 3339 dates and times compared
+// chronologically by conditions.
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02"}
+
+// parseTime parses s as an RFC 3339 date or time, reporting whether it is
+// one.
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,103 @@
+package xhub_test
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure lists can be filtered by conditions on their data payloads.
+func TestFilter(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for path, doc := range map[string]string{
+		"/studies/a": `{"lab":"north","year":2017}`,
+		"/studies/b": `{"lab":"south","year":2018}`,
+		"/studies/a/trials/t1": `{"subject":"rat_3","weight":9.5,` +
+			`"date":"2018-01-05","tags":["pilot"],"done":true}`,
+		"/studies/a/trials/t2": `{"subject":"rat_10","weight":10,` +
+			`"date":"2018-01-05T12:00:00Z","tags":["main"],"done":false}`,
+		"/studies/a/trials/t3": `{"subject":"rat_3","weight":null,` +
+			`"date":"2018-02-01T00:00:00-05:00","note":null}`,
+		"/studies/a/files/f1": `{"format":"csv"}`,
+		"/studies/a/files/f2": `{"format":"json"}`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		path  string
+		where []string
+		want  []string
+	}{
+		{"/studies/a/trials", nil, []string{"t1", "t2", "t3"}},
+		{"/studies/a/trials", []string{"data.subject=rat_3"},
+			[]string{"t1", "t3"}},
+		{"/studies/a/trials", []string{"data.subject!=rat_3"},
+			[]string{"t2"}},
+		// Numbers compare numerically; values of other types only differ.
+		{"/studies/a/trials", []string{"data.weight>9.75"}, []string{"t2"}},
+		{"/studies/a/trials", []string{"data.weight<=10"},
+			[]string{"t1", "t2"}},
+		{"/studies/a/trials", []string{"data.weight!=10"},
+			[]string{"t1", "t3"}},
+		// Strings compare lexically, dates chronologically.
+		{"/studies/a/trials", []string{"data.subject<rat_2"},
+			[]string{"t2"}},
+		{"/studies/a/trials", []string{"data.date>2018-01-05"},
+			[]string{"t2", "t3"}},
+		{"/studies/a/trials", []string{"data.date<2018-02-01T04:00:00Z"},
+			[]string{"t1", "t2"}},
+		// Conditions on missing values are only met by !=.
+		{"/studies/a/trials", []string{"data.note=null"}, []string{"t3"}},
+		{"/studies/a/trials", []string{"data.done=true"}, []string{"t1"}},
+		{"/studies/a/trials", []string{"data.done!=true"},
+			[]string{"t2", "t3"}},
+		{"/studies/a/trials", []string{"data.tags.0=main"}, []string{"t2"}},
+		{"/studies/a/trials", []string{"data.missing=x"}, nil},
+		{"/studies/a/trials", []string{"data.missing!=x"},
+			[]string{"t1", "t2", "t3"}},
+		{"/studies/a/trials", []string{"data.subject=rat_3",
+			"data.date>=2018-01-05"}, []string{"t1", "t3"}},
+		{"/studies/a/trials", []string{"data.subject=rat_3",
+			"data.weight<10"}, []string{"t1"}},
+		{"/studies/a/files", []string{"data.format=json"}, []string{"f2"}},
+		{"/studies", []string{"data.year>=2018"}, []string{"b"}},
+	} {
+		q := url.Values{"where": tt.where}
+		got := listPages(t, srv.addr+tt.path+"?"+q.Encode(), 1)
+		want := tt.want
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("list %s where %v: want %v, got %v", tt.path, tt.where,
+				want, got)
+		}
+	}
+
+	// Filtered lists can still be paginated.
+	q := url.Values{"where": {"data.subject=rat_3"}, "limit": {"1"}}
+	url := srv.addr + "/studies/a/trials?" + q.Encode()
+	want := []string{"t1", "t3"}
+	if got := listPages(t, url, 2); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for _, where := range []string{
+		"subject=rat_3",
+		"data.subject",
+		"data=x",
+		"data..subject=x",
+		"data.subject!x",
+	} {
+		url := srv.addr + "/studies/a/trials?where=" + where
+		if want, got := http.StatusBadRequest, status(t, "GET", url); want != got {
+			t.Errorf("where=%s: want %d, got %d", where, want, got)
+		}
+	}
+}
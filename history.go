@@ -0,0 +1,263 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// The revision history of each resource is kept in the store's history
+// bucket, with each revision's record stored under a key extending the
+// resource id by an "@" segment and the revision number (see historyKey).
+// As "@" isn't allowed in resource names, revisions never collide with
+// resource ids, and deleting the tree rooted at an id in the history
+// bucket deletes the history of the resource and all its descendants.
+
+// historyKey returns the key of revision rev of the resource id in the
+// history bucket.  Revision numbers are zero-padded so that revisions are
+// kept in order.
+func historyKey(id string, rev int) []byte {
+	return []byte(fmt.Sprintf("%s/@/%012d", id, rev))
+}
+
+// revisions returns the records of all revisions of the resource id, in
+// order.
+func revisions(tx Tx, id string) ([]*record, error) {
+	items, err := tx.Children(historyBucket, []byte(id+"/@"))
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*record, len(items))
+	for i, item := range items {
+		if recs[i], err = decodeRecord(item.Value); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// getRevision returns the record of revision rev of the resource id, or
+// nil if there's no such revision.
+func getRevision(tx Tx, id string, rev int) (*record, error) {
+	v, err := tx.Get(historyBucket, historyKey(id, rev))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return decodeRecord(v)
+}
+
+// lastRevision returns the number of the latest revision in the history
+// of the resource id, which is zero if it has no history.
+func lastRevision(tx Tx, id string) (int, error) {
+	recs, err := revisions(tx, id)
+	if err != nil || len(recs) == 0 {
+		return 0, err
+	}
+	return recs[len(recs)-1].Rev, nil
+}
+
+// appendHistory adds rec to the history of the resource id.
+func appendHistory(tx Tx, id string, rec *record) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Put(historyBucket, historyKey(id, rec.Rev), v)
+}
+
+// listHistory handles GET requests for the history of the resource id,
+// returning a list of its revisions, oldest first.  The history of deleted
+// resources can still be listed.
+func listHistory(w http.ResponseWriter, r *http.Request, host string,
+	store Store, config *Config, id string) {
+
+	var recs []*record
+	err := store.View(func(tx Tx) (err error) {
+		recs, err = revisions(tx, id)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(recs) == 0 {
+		config.notFound(w, r, id+"/history")
+		return
+	}
+
+	revs := []*Revision{}
+	for _, rec := range recs {
+		url := fmt.Sprintf("http://%s%s/history/%d", host, id, rec.Rev)
+		revs = append(revs, &Revision{
+			Rev:      rec.Rev,
+			URL:      url,
+			Modified: rec.Modified,
+			Editor:   rec.Editor,
+			Size:     len(rec.Data),
+		})
+	}
+	writeTagged(w, r, revs)
+}
+
+// getHistory handles GET requests for the revision of the resource id of
+// type typ given by the request's rev parameter, returning the revision's
+// raw json data payload.  As with current revisions, the payload is
+// wrapped in a Resource if the envelope or fields parameter is given.
+func getHistory(w http.ResponseWriter, r *http.Request, host string,
+	store Store, config *Config, typ, id, rev string) {
+
+	n, err := revParam(rev)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	envelope, err := boolParam(r, "envelope")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := fieldsParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rec *record
+	err = store.View(func(tx Tx) (err error) {
+		rec, err = getRevision(tx, id, n)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rec == nil {
+		config.notFound(w, r, fmt.Sprintf("%s/history/%d", id, n))
+		return
+	}
+
+	var rsc *Resource
+	if envelope || fields != nil {
+		rsc = newResource(host, typ, id, rec)
+	}
+	writeRecord(w, r, rec, rsc, fields)
+}
+
+// diffHistory handles GET requests for the differences between two
+// revisions of the resource id, given by the request's from and to
+// parameters, returning a json patch transforming the data payload of the
+// former into that of the latter.  If to is omitted, the current revision
+// is used.
+func diffHistory(w http.ResponseWriter, r *http.Request, store Store,
+	id string) {
+
+	q := r.URL.Query()
+	from, err := revParam(q.Get("from"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	to := 0
+	if v := q.Get("to"); v != "" {
+		if to, err = revParam(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var patch jsonPatch
+	err = store.View(func(tx Tx) error {
+		if to == 0 {
+			rec, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				return errorf(http.StatusNotFound, "%s not found", id)
+			}
+			to = rec.Rev
+		}
+		var docs [2]interface{}
+		for i, rev := range []int{from, to} {
+			rec, err := getRevision(tx, id, rev)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				return errorf(http.StatusNotFound,
+					"%s/history/%d not found", id, rev)
+			}
+			if docs[i], err = decodeJSON(rec.Data); err != nil {
+				return err
+			}
+		}
+		patch, err = diffJSON(docs[0], docs[1])
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", jsonPatchType)
+	w.Write(data)
+}
+
+// revertResource handles POST requests for reverting the resource id to
+// the revision given by the request's rev parameter, storing the data
+// payload of that revision as a new revision.  If the request carries an
+// If-Match header, it's checked against the current revision.
+func revertResource(w http.ResponseWriter, r *http.Request, store Store,
+	id string) {
+
+	rev, err := revParam(r.URL.Query().Get("rev"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rec *record
+	err = store.Update(func(tx Tx) error {
+		old, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, id, old); err != nil {
+			return err
+		}
+		if old == nil {
+			return errorf(http.StatusNotFound, "%s not found", id)
+		}
+		prev, err := getRevision(tx, id, rev)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			return errorf(http.StatusNotFound,
+				"%s/history/%d not found", id, rev)
+		}
+		rec, err = putRecord(tx, id, old, prev.Data, author(r))
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", rec.ETag())
+	writeDocument(w, http.StatusOK, rec.Data)
+}
+
+// revParam parses the revision number v given as a request parameter.
+func revParam(v string) (int, error) {
+	rev, err := strconv.Atoi(v)
+	if err != nil || rev < 1 {
+		return 0, fmt.Errorf("invalid revision %q: expecting a positive "+
+			"integer", v)
+	}
+	return rev, nil
+}
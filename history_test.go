@@ -0,0 +1,185 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure each write is kept in a resource's revision history.
+func TestHistory(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+	} {
+		url := srv.addr + path
+		for i, doc := range []string{`{"n":1}`, `{"n":22}`} {
+			header := map[string]string{"From": fmt.Sprintf("user%d", i+1)}
+			res := sendWith(t, "PUT", url, header, strings.NewReader(doc))
+			res.Body.Close()
+		}
+
+		res := send(t, "GET", url+"/history", nil)
+		var revs []Revision
+		if err := json.NewDecoder(res.Body).Decode(&revs); err != nil {
+			t.Fatalf("error decoding history of %s: %v", path, err)
+		}
+		res.Body.Close()
+		if want, got := 2, len(revs); want != got {
+			t.Fatalf("%s: want %d revisions, got %d", path, want, got)
+		}
+		for i, rev := range revs {
+			if want, got := i+1, rev.Rev; want != got {
+				t.Errorf("%s: want rev %d, got %d", path, want, got)
+			}
+			if want, got := len(`{"n":1}`)+i, rev.Size; want != got {
+				t.Errorf("%s: want size %d, got %d", path, want, got)
+			}
+			if want, got := fmt.Sprintf("user%d", i+1), rev.Editor; want != got {
+				t.Errorf("%s: want editor %s, got %s", path, want, got)
+			}
+			suffix := fmt.Sprintf("%s/history/%d", path, i+1)
+			if rev.Modified == "" || !strings.HasSuffix(rev.URL, suffix) {
+				t.Errorf("%s: incomplete revision %+v", path, rev)
+			}
+		}
+
+		// Old revisions can be retrieved.
+		res = send(t, "GET", url+"/history/1", nil)
+		res.Body.Close()
+		if want, got := `"1"`, res.Header.Get("ETag"); want != got {
+			t.Errorf("%s: want ETag %s, got %s", path, want, got)
+		}
+		want := map[string]interface{}{"n": 1.0}
+		if got := getDocument(t, url+"/history/1"); !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: want %v, got %v", path, want, got)
+		}
+		for _, rev := range []string{"3", "0", "x"} {
+			want := http.StatusNotFound
+			if rev != "3" {
+				want = http.StatusBadRequest
+			}
+			if got := status(t, "GET", url+"/history/"+rev); want != got {
+				t.Errorf("%s rev %s: want %d, got %d", path, rev, want, got)
+			}
+		}
+	}
+
+	// A deleted and recreated resource carries on its history.
+	url := srv.addr + "/studies/a/files/f1"
+	status(t, "DELETE", url)
+	res := send(t, "PUT", url, strings.NewReader(`{}`))
+	res.Body.Close()
+	if want, got := `"3"`, res.Header.Get("ETag"); want != got {
+		t.Errorf("want ETag %s, got %s", want, got)
+	}
+
+	path := "/studies/b/history"
+	if want, got := http.StatusNotFound, status(t, "GET", srv.addr+path); want != got {
+		t.Errorf("GET %s: want %d, got %d", path, want, got)
+	}
+}
+
+// A Revision models an entry in a resource's history.
+type Revision struct {
+	Rev      int    `json:"rev"`
+	URL      string `json:"url"`
+	Modified string `json:"modified"`
+	Editor   string `json:"editor"`
+	Size     int    `json:"size"`
+}
+
+// Ensure revisions can be compared and reverted to.
+func TestDiffRevert(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	url := srv.addr + "/studies/a/trials/t1"
+	for _, doc := range []string{
+		`{"subject":"rat_1","tags":["x","y","z"],"rig":{"fps":250,"cam":1},"a/b":1}`,
+		`{"subject":"rat_2","tags":["x","w"],"rig":{"fps":250},"a/b":2,"new":null}`,
+	} {
+		res := send(t, "PUT", url, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		query, want string
+	}{
+		{"?from=1&to=2", `[
+			{"op":"replace","path":"/a~1b","value":2},
+			{"op":"add","path":"/new","value":null},
+			{"op":"remove","path":"/rig/cam"},
+			{"op":"replace","path":"/subject","value":"rat_2"},
+			{"op":"replace","path":"/tags/1","value":"w"},
+			{"op":"remove","path":"/tags/2"}
+		]`},
+		{"?from=2", `[]`},
+		{"?from=2&to=1", `[
+			{"op":"remove","path":"/new"},
+			{"op":"replace","path":"/a~1b","value":1},
+			{"op":"add","path":"/rig/cam","value":1},
+			{"op":"replace","path":"/subject","value":"rat_1"},
+			{"op":"replace","path":"/tags/1","value":"y"},
+			{"op":"add","path":"/tags/2","value":"z"}
+		]`},
+	} {
+		res := send(t, "GET", url+"/diff"+tt.query, nil)
+		var got, want interface{}
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatalf("error decoding diff: %v", err)
+		}
+		res.Body.Close()
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("error decoding %s: %v", tt.want, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("diff%s:\nwant %v\n got %v", tt.query, want, got)
+		}
+		if want, got := "application/json-patch+json",
+			res.Header.Get("Content-Type"); want != got {
+			t.Errorf("want content type %s, got %s", want, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/diff", http.StatusBadRequest},
+		{"GET", "/diff?from=1&to=x", http.StatusBadRequest},
+		{"GET", "/diff?from=1&to=3", http.StatusNotFound},
+		{"POST", "/revert", http.StatusBadRequest},
+		{"POST", "/revert?rev=3", http.StatusNotFound},
+	} {
+		if want, got := tt.status,
+			status(t, tt.method, url+tt.path); want != got {
+			t.Errorf("%s %s: want %d, got %d", tt.method, tt.path, want, got)
+		}
+	}
+
+	// Reverting to the first revision restores it as a third.
+	res := send(t, "POST", url+"/revert?rev=1", nil)
+	res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	if want, got := `"3"`, res.Header.Get("ETag"); want != got {
+		t.Errorf("want ETag %s, got %s", want, got)
+	}
+	res = send(t, "GET", url+"/diff?from=1&to=3", nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if want, got := "[]", string(body); want != got {
+		t.Errorf("want no differences, got %s", got)
+	}
+}
@@ -0,0 +1,264 @@
+package xhub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Clients can safely retry a POST request by sending a key of their
+// choosing (e.g., a random UUID) in its Idempotency-Key header.  The
+// response to the first request carrying a key is kept in the store's
+// idempotency bucket, keyed by the key, and replayed in response to later
+// requests carrying the same key, rather than handling them again.  Keys
+// are forgotten once the configured window has passed.
+//
+// A key is claimed by storing a pending response for it before its
+// request is handled, so that a request whose response never gets
+// recorded (e.g., as the store fails, or the server stops) is never
+// handled twice: requests retrying it fail until the key is forgotten.
+
+// idempotencyHeader is the request header carrying an idempotency key.
+const idempotencyHeader = "Idempotency-Key"
+
+// replayedHeader marks responses replayed for a retried request.
+const replayedHeader = "Idempotent-Replayed"
+
+// maxKeyLen is the maximum length of an idempotency key, in bytes.
+const maxKeyLen = 255
+
+// DefaultIdempotencyWindow is how long the responses to requests carrying
+// an idempotency key are kept, unless configured otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// replayHeaders lists the response headers replayed along with the status
+// and body of a response.
+var replayHeaders = []string{"Content-Type", "ETag", "Link", "Accept-Patch"}
+
+// A response is the stored representation of the response to a request
+// carrying an idempotency key.
+type response struct {
+	Created string            `json:"created"`           // time recorded
+	Request string            `json:"request"`           // see fingerprint
+	Pending bool              `json:"pending,omitempty"` // not yet handled
+	Status  int               `json:"status"`            // http status code
+	Header  map[string]string `json:"header,omitempty"`  // see replayHeaders
+	Body    []byte            `json:"body,omitempty"`
+}
+
+// fingerprint identifies the request r with the given body, so that a key
+// can't be reused for a different request.
+func fingerprint(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	return r.Method + " " + r.URL.RequestURI() + " " +
+		hex.EncodeToString(sum[:])
+}
+
+// getResponse returns the response recorded for key since the given time,
+// or nil if there's none.
+func getResponse(tx Tx, key string, since time.Time) (*response, error) {
+	v, err := tx.Get(idempotencyBucket, []byte(key))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	resp := new(response)
+	if err := json.Unmarshal(v, resp); err != nil {
+		return nil, err
+	}
+	created, err := time.Parse(time.RFC3339Nano, resp.Created)
+	if err != nil {
+		return nil, err
+	}
+	if created.Before(since) {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// replay writes the recorded response to w.
+func (resp *response) replay(w http.ResponseWriter) {
+	for name, v := range resp.Header {
+		w.Header().Set(name, v)
+	}
+	w.Header().Set(replayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// putResponse records resp as the response for key.
+func putResponse(tx Tx, key string, resp *response) error {
+	v, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return tx.Put(idempotencyBucket, []byte(key), v)
+}
+
+// claimKey claims key for the request with the given fingerprint, storing
+// a pending response for it, unless a response has been recorded for the
+// key since the given time, in which case that response is returned.
+func claimKey(store Store, key, request string, since time.Time) (
+	resp *response, err error) {
+
+	err = store.Update(func(tx Tx) error {
+		if resp, err = getResponse(tx, key, since); err != nil ||
+			resp != nil {
+			return err
+		}
+		return putResponse(tx, key, &response{
+			Created: time.Now().UTC().Format(time.RFC3339Nano),
+			Request: request,
+			Pending: true,
+		})
+	})
+	return resp, err
+}
+
+// A recorder is a ResponseWriter recording the response written to it,
+// to be sent on once it's been stored.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+// send writes the recorded response to w.
+func (rec *recorder) send(w http.ResponseWriter) {
+	for name, v := range rec.header {
+		w.Header()[name] = v
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// serveIdempotent handles the POST request r carrying the idempotency key,
+// replaying the response recorded for the key if there is one, and
+// otherwise claiming the key, handling the request, and recording its
+// response.  Server errors aren't recorded, and release the key so that
+// the request can be retried.  Requests reusing a key for a different
+// request fail with 422 Unprocessable Entity, while requests carrying a
+// key whose request is still being handled, or whose response couldn't be
+// recorded, fail with 409 Conflict.
+func (s *Server) serveIdempotent(w http.ResponseWriter, r *http.Request,
+	key string) {
+
+	if len(key) > maxKeyLen {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s header "+
+			"is %d bytes long (maximum is %d)", idempotencyHeader,
+			len(key), maxKeyLen))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request := fingerprint(r, body)
+
+	since := time.Now().Add(-s.Config.IdempotencyWindow)
+	resp, err := claimKey(s.store, key, request, since)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if resp != nil {
+		switch {
+		case resp.Request != request:
+			writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf(
+				"idempotency key %q was used for a different request", key))
+		case resp.Pending:
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("the "+
+				"request with idempotency key %q is still in progress, "+
+				"or its outcome is unknown", key))
+		default:
+			resp.replay(w)
+		}
+		return
+	}
+
+	rec := &recorder{header: http.Header{}}
+	s.handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 500 {
+		err = s.store.Delete(idempotencyBucket, []byte(key))
+	} else {
+		resp = &response{
+			Created: time.Now().UTC().Format(time.RFC3339Nano),
+			Request: request,
+			Status:  rec.status,
+			Header:  map[string]string{},
+			Body:    rec.body.Bytes(),
+		}
+		for _, name := range replayHeaders {
+			if v := rec.header.Get(name); v != "" {
+				resp.Header[name] = v
+			}
+		}
+		err = s.store.Update(func(tx Tx) error {
+			return putResponse(tx, key, resp)
+		})
+	}
+	if err != nil {
+		// The key stays claimed, so the request can't be handled again.
+		log.Printf("couldn't record response for idempotency key %q: %v\n",
+			key, err)
+	}
+	rec.send(w)
+}
+
+// purgeResponses removes the responses recorded before the given time
+// from store, returning the number removed.
+func purgeResponses(store Store, before time.Time) (n int, err error) {
+	err = store.Update(func(tx Tx) error {
+		n = 0
+		items, err := tx.Items(idempotencyBucket)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			var resp response
+			if err := json.Unmarshal(item.Value, &resp); err != nil {
+				return err
+			}
+			created, err := time.Parse(time.RFC3339Nano, resp.Created)
+			if err != nil {
+				return err
+			}
+			if !created.Before(before) {
+				continue
+			}
+			if err := tx.Delete(idempotencyBucket, item.Key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
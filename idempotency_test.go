@@ -0,0 +1,186 @@
+package xhub_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joyrexus/xhub"
+)
+
+// Ensure retried POST requests carrying an idempotency key receive the
+// original response rather than being handled again.
+func TestIdempotency(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	trial := `{"version":"0.1","resource":"trial",` +
+		`"id":"/studies/a/trials/t1","data":{"n":1}}`
+	url := srv.addr + "/studies/a/trials"
+	header := map[string]string{"Idempotency-Key": "k1"}
+	res := sendWith(t, "POST", url, header, strings.NewReader(trial))
+	res.Body.Close()
+	if want, got := http.StatusCreated, res.StatusCode; want != got {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+
+	// The trial is changed after the POST, which isn't handled again.
+	res = send(t, "PUT", srv.addr+"/studies/a/trials/t1",
+		strings.NewReader(`{"n":2}`))
+	res.Body.Close()
+	res = sendWith(t, "POST", url, header, strings.NewReader(trial))
+	res.Body.Close()
+	if want, got := http.StatusCreated, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	if want, got := `"1"`, res.Header.Get("ETag"); want != got {
+		t.Errorf("want replayed etag %s, got %s", want, got)
+	}
+	if want, got := "true", res.Header.Get("Idempotent-Replayed"); want != got {
+		t.Errorf("want response marked as replayed, got %q", got)
+	}
+	res = send(t, "GET", srv.addr+"/studies/a/trials/t1", nil)
+	res.Body.Close()
+	if want, got := `"2"`, res.Header.Get("ETag"); want != got {
+		t.Errorf("want etag %s, got %s", want, got)
+	}
+
+	// Bodies are replayed along with the status.
+	batch := `[{"op":"delete","id":"/studies/a/trials/t1"}]`
+	header = map[string]string{"Idempotency-Key": "k2"}
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		res = sendWith(t, "POST", srv.addr+"/batch", header,
+			strings.NewReader(batch))
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		bodies = append(bodies, string(body))
+	}
+	if !strings.Contains(bodies[0], `"status":200`) || bodies[1] != bodies[0] {
+		t.Errorf("want original response replayed, got %s then %s",
+			bodies[0], bodies[1])
+	}
+
+	for _, tt := range []struct {
+		url, key, body string
+		want           int
+	}{
+		// a key can't be reused for another request
+		{url, "k1", strings.Replace(trial, "1}", "3}", 1),
+			http.StatusUnprocessableEntity},
+		{srv.addr + "/batch?atomic=true", "k2", batch,
+			http.StatusUnprocessableEntity},
+		{url, strings.Repeat("k", 256), trial, http.StatusBadRequest},
+		// requests without a key, or with a new one, are handled as usual
+		{url, "", trial, http.StatusCreated},
+		{srv.addr + "/batch", "k3", batch, http.StatusOK},
+	} {
+		header := map[string]string{"Idempotency-Key": tt.key}
+		res := sendWith(t, "POST", tt.url, header, strings.NewReader(tt.body))
+		res.Body.Close()
+		if got := res.StatusCode; tt.want != got {
+			t.Errorf("POST %s with key %.8q: want %d, got %d", tt.url,
+				tt.key, tt.want, got)
+		}
+		if got := res.Header.Get("Idempotent-Replayed"); got != "" {
+			t.Errorf("POST %s with key %.8q: want response not replayed",
+				tt.url, tt.key)
+		}
+	}
+}
+
+// Ensure the responses kept for idempotency keys expire.
+func TestIdempotencyWindow(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+	srv.server.Config.IdempotencyWindow = 200 * time.Millisecond
+
+	batch := `[{"op":"create","id":"/studies/a","data":{}}]`
+	header := map[string]string{"Idempotency-Key": "k1"}
+	for _, want := range []string{"201", "201", "409"} {
+		res := sendWith(t, "POST", srv.addr+"/batch", header,
+			strings.NewReader(batch))
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if !strings.Contains(string(body), `"status":`+want) {
+			t.Errorf("want operation status %s, got %s", want, body)
+		}
+		time.Sleep(120 * time.Millisecond)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	n, err := srv.server.PurgeResponses()
+	if err != nil {
+		t.Fatalf("error purging responses: %v", err)
+	}
+	if want, got := 1, n; want != got {
+		t.Errorf("want %d response purged, got %d", want, got)
+	}
+}
+
+// Ensure requests whose responses can't be recorded aren't handled again
+// when retried.
+func TestIdempotencyFailure(t *testing.T) {
+	// Pending responses are stored, but not the responses replacing them.
+	store := &failingStore{xhub.NewMemStore(), func(bucket, v []byte) bool {
+		return string(bucket) == "idempotency" &&
+			!bytes.Contains(v, []byte(`"pending":true`))
+	}}
+	srv := httptest.NewServer(xhub.NewServerWithStore("localhost:8081",
+		store))
+	defer srv.Close()
+
+	trial := `{"version":"0.1","resource":"trial",` +
+		`"id":"/studies/a/trials/t1","data":{"n":1}}`
+	url := srv.URL + "/studies/a/trials"
+	header := map[string]string{"Idempotency-Key": "k1"}
+	for _, want := range []int{http.StatusCreated, http.StatusConflict} {
+		res := sendWith(t, "POST", url, header, strings.NewReader(trial))
+		res.Body.Close()
+		if got := res.StatusCode; want != got {
+			t.Errorf("want %d, got %d", want, got)
+		}
+	}
+	res := send(t, "GET", url+"/t1", nil)
+	res.Body.Close()
+	if want, got := `"1"`, res.Header.Get("ETag"); want != got {
+		t.Errorf("want trial written once (etag %s), got etag %s", want, got)
+	}
+}
+
+// A failingStore is a store failing to put the values for which fail
+// reports true, as if it had run out of space.
+type failingStore struct {
+	xhub.Store
+	fail func(bucket, value []byte) bool
+}
+
+func (s *failingStore) Put(bucket, key, value []byte) error {
+	return s.Update(func(tx xhub.Tx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+func (s *failingStore) Update(fn func(xhub.Tx) error) error {
+	return s.Store.Update(func(tx xhub.Tx) error {
+		return fn(&failingTx{tx, s.fail})
+	})
+}
+
+// A failingTx is a transaction of a failingStore.
+type failingTx struct {
+	xhub.Tx
+	fail func(bucket, value []byte) bool
+}
+
+func (tx *failingTx) Put(bucket, key, value []byte) error {
+	if tx.fail(bucket, value) {
+		return errors.New("no space left in store")
+	}
+	return tx.Tx.Put(bucket, key, value)
+}
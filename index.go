@@ -0,0 +1,449 @@
+package xhub
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Indexes declares the paths within the data payloads of resources whose
+// values are indexed, by resource type ("study", "trial", or "file").
+// Paths have the form `data.PATH`, as in the where parameters of list
+// requests (e.g., `Indexes{"trial": {"data.subject", "data.date"}}`).
+type Indexes map[string][]string
+
+// The indexes declared for a store are kept in its meta bucket (see
+// indexesKey), and the entries of the index on the path PATH of resources
+// of type TYPE are kept in its index bucket as the children of the key
+// `TYPE/PATH`.  The key of each entry is the value indexed, encoded so
+// that keys sort in the order of their values (see indexValue), followed
+// by "!" and the escaped id of the resource, which is the entry's value.
+// Entries for equal values are thus adjacent, and the entries for a range
+// of ordered values form a run of keys.
+//
+// Index entries are updated along with the records of resources, in the
+// same transaction.
+
+// indexesKey is the key in the meta bucket holding a store's indexes.
+var indexesKey = []byte("indexes")
+
+// Tags beginning encoded index values, ordering values of different types.
+const (
+	nullTag   = '0'
+	boolTag   = '1'
+	numberTag = '2'
+	timeTag   = '3'
+	stringTag = '4'
+)
+
+// indexTimeLayout is the layout of encoded times, which sort in order as
+// long as their years have four digits.
+const indexTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// NewIndexController initializes a new instance of our index controller.
+func NewIndexController(host string, store Store,
+	config *Config) *IndexController {
+
+	return &IndexController{host, store, config}
+}
+
+// An IndexController handles requests for looking up resources by the
+// values of indexed paths in their data payloads.
+type IndexController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// validate checks that each index names a resource type and a valid path.
+func (idx Indexes) validate() error {
+	for typ, paths := range idx {
+		switch typ {
+		case "study", "trial", "file":
+		default:
+			return fmt.Errorf("invalid resource type %q: expecting study, "+
+				"trial, or file", typ)
+		}
+		for _, path := range paths {
+			if _, err := parsePath(path); err != nil {
+				return fmt.Errorf("invalid index path %q: %v", path, err)
+			}
+			if strings.Contains(path, "/") {
+				return fmt.Errorf("invalid index path %q: paths can't "+
+					"contain \"/\"", path)
+			}
+		}
+	}
+	return nil
+}
+
+// getIndexes returns the indexes declared for the store of tx.
+func getIndexes(tx Tx) (Indexes, error) {
+	v, err := tx.Get(metaBucket, indexesKey)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	var idx Indexes
+	if err := json.Unmarshal(v, &idx); err != nil {
+		return nil, fmt.Errorf("couldn't decode declared indexes: %v", err)
+	}
+	return idx, nil
+}
+
+// reindex declares the given indexes for store, replacing any declared
+// before, and rebuilds them from the records of all resources.
+func reindex(store Store, idx Indexes) error {
+	if err := idx.validate(); err != nil {
+		return err
+	}
+	v, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return store.Update(func(tx Tx) error {
+		if err := tx.Put(metaBucket, indexesKey, v); err != nil {
+			return err
+		}
+		items, err := tx.Items(indexBucket)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := tx.Delete(indexBucket, item.Key); err != nil {
+				return err
+			}
+		}
+		if items, err = tx.Items(studiesBucket); err != nil {
+			return err
+		}
+		for _, item := range items {
+			rec, err := decodeRecord(item.Value)
+			if err != nil {
+				return err
+			}
+			err = updateIndexes(tx, idx, string(item.Key), nil, rec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexRecord updates the index entries of the resource id, along with its
+// search index entries, as its record is replaced by rec.  Either record
+// is nil if the resource is being created or deleted, respectively.
+func indexRecord(tx Tx, id string, old, rec *record) error {
+	if err := updateSearch(tx, id, old, rec); err != nil {
+		return err
+	}
+	idx, err := getIndexes(tx)
+	if err != nil || len(idx) == 0 {
+		return err
+	}
+	return updateIndexes(tx, idx, id, old, rec)
+}
+
+// unindexItems removes the index entries of the resources whose stored
+// records are the given items, as deleted from the studies bucket.
+func unindexItems(tx Tx, items []Item) error {
+	for _, item := range items {
+		rec, err := decodeRecord(item.Value)
+		if err != nil {
+			return err
+		}
+		if err := indexRecord(tx, string(item.Key), rec, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndexes replaces the entries of the resource id in the indexes
+// idx for its old record with those for rec.
+func updateIndexes(tx Tx, idx Indexes, id string, old, rec *record) error {
+	typ := resourceType(id)
+	for _, path := range idx[typ] {
+		prefix := typ + "/" + path + "/"
+		suffix := "!" + url.PathEscape(id)
+		values, err := indexValues(old, path)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			key := []byte(prefix + v + suffix)
+			if err := tx.Delete(indexBucket, key); err != nil {
+				return err
+			}
+		}
+		if values, err = indexValues(rec, path); err != nil {
+			return err
+		}
+		for _, v := range values {
+			key := []byte(prefix + v + suffix)
+			if err := tx.Put(indexBucket, key, []byte(id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexValues returns the encoded values at path in the data payload of
+// rec to be indexed.  An array is indexed by each of its elements, while
+// objects and missing values aren't indexed.
+func indexValues(rec *record, path string) ([]string, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	doc, err := decodeJSON(rec.Data)
+	if err != nil {
+		return nil, fmt.Errorf("stored document is invalid: %v", err)
+	}
+	names, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := lookup(doc, names)
+	if !ok {
+		return nil, nil
+	}
+	elems, ok := v.([]interface{})
+	if !ok {
+		elems = []interface{}{v}
+	}
+	var values []string
+	for _, elem := range elems {
+		if s, ok := indexValue(elem); ok {
+			values = append(values, s)
+		}
+	}
+	return values, nil
+}
+
+// indexValue encodes the decoded json value v for indexing, reporting
+// whether it can be indexed.  As in the conditions of where parameters,
+// strings holding RFC 3339 dates or times are treated as times.
+func indexValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return string(nullTag), true
+	case bool:
+		return encodeOperand(boolTag, strconv.FormatBool(x))
+	case json.Number:
+		return encodeOperand(numberTag, x.String())
+	case string:
+		if s, ok := encodeOperand(timeTag, x); ok {
+			return s, true
+		}
+		return encodeOperand(stringTag, x)
+	}
+	return "", false
+}
+
+// encodeOperand encodes the value s given in a lookup request as a value of
+// the type with the given tag, reporting whether it's a value of that type.
+func encodeOperand(tag byte, s string) (string, bool) {
+	switch tag {
+	case nullTag:
+		return string(nullTag), s == "null"
+	case boolTag:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return "", false
+		}
+		if b {
+			return string(boolTag) + "1", true
+		}
+		return string(boolTag) + "0", true
+	case numberTag:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) {
+			return "", false
+		}
+		// Flip the sign bit of positive numbers and all bits of negative
+		// ones, so that the bits sort in the numbers' order.
+		bits := math.Float64bits(f)
+		if bits>>63 == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return fmt.Sprintf("%c%016x", numberTag, bits), true
+	case timeTag:
+		t, ok := parseTime(s)
+		if !ok {
+			return "", false
+		}
+		return string(timeTag) + t.UTC().Format(indexTimeLayout), true
+	case stringTag:
+		return string(stringTag) + hex.EncodeToString([]byte(s)), true
+	}
+	return "", false
+}
+
+// A valueRange is an inclusive range of encoded values.
+type valueRange struct {
+	min, max string
+}
+
+// lookupRanges returns the ranges of encoded values requested by the value,
+// or the min and max, query parameters of a lookup request.  A value may
+// match values of several types (e.g., the number 3 or the string "3"),
+// while a range only spans numbers, times, or strings.
+func lookupRanges(q url.Values) ([]valueRange, error) {
+	var ranges []valueRange
+	if _, ok := q["value"]; ok {
+		for _, tag := range []byte{nullTag, boolTag, numberTag, timeTag,
+			stringTag} {
+			if v, ok := encodeOperand(tag, q.Get("value")); ok {
+				ranges = append(ranges, valueRange{v, v})
+			}
+		}
+		return ranges, nil
+	}
+	min, hasMin := q["min"]
+	max, hasMax := q["max"]
+	if !hasMin && !hasMax {
+		return nil, fmt.Errorf("missing value parameter: expecting a " +
+			"value, or a min or max")
+	}
+	for _, tag := range []byte{numberTag, timeTag, stringTag} {
+		r := valueRange{string(tag), string(tag) + "\xff"}
+		var ok bool
+		if hasMin {
+			if r.min, ok = encodeOperand(tag, min[0]); !ok {
+				continue
+			}
+		}
+		if hasMax {
+			if r.max, ok = encodeOperand(tag, max[0]); !ok {
+				continue
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// lookupIndex returns the ids of the resources of type typ whose values at
+// path fall within any of the given ranges, in the order of their values.
+// The entries in each range are read as a run of keys, seeking to the
+// first rather than scanning the whole index.
+func lookupIndex(tx Tx, typ, path string, ranges []valueRange) ([]string,
+	error) {
+
+	prefix := typ + "/" + path + "/"
+	ids := []string{}
+	seen := map[string]bool{}
+	add := func(item Item) error {
+		id := string(item.Value)
+		if !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+		return nil
+	}
+	for _, r := range ranges {
+		// Encoded values never hold "!" or the bytes before it, so the
+		// entries for the values up to r.max precede r.max followed by
+		// the byte after "!".
+		from := []byte(prefix + r.min)
+		to := []byte(prefix + r.max + "\"")
+		if err := tx.EachRange(indexBucket, from, to, add); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// Lookup handles GET requests for `/lookup`, returning a list of the
+// resources whose data payloads hold a given value at an indexed path.
+// The request's path parameter gives the path (e.g., `data.subject`), and
+// the value parameter the value sought.  Alternatively, the min and max
+// parameters give an inclusive range of values, either of which may be
+// omitted.  The resource parameter restricts the lookup to resources of
+// the given type; otherwise all types indexed on the path are searched.
+func (c *IndexController) Lookup(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+
+	q := r.URL.Query()
+	path := q.Get("path")
+	if _, err := parsePath(path); err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			fmt.Sprintf("invalid path parameter %q: %v", path, err))
+		return
+	}
+	typ := q.Get("resource")
+	switch typ {
+	case "", "study", "trial", "file":
+	default:
+		writeError(w, r, http.StatusBadRequest,
+			fmt.Sprintf("invalid resource parameter %q: expecting study, "+
+				"trial, or file", typ))
+		return
+	}
+	ranges, err := lookupRanges(q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resources := []*Resource{}
+	err = c.store.View(func(tx Tx) error {
+		idx, err := getIndexes(tx)
+		if err != nil {
+			return err
+		}
+		var types []string
+		for t, paths := range idx {
+			if typ != "" && t != typ {
+				continue
+			}
+			for _, p := range paths {
+				if p == path {
+					types = append(types, t)
+				}
+			}
+		}
+		if len(types) == 0 {
+			return errorf(http.StatusBadRequest, "%s isn't indexed", path)
+		}
+		// List studies before trials before files.
+		sort.Slice(types, func(i, j int) bool {
+			return strings.Index("study trial file", types[i]) <
+				strings.Index("study trial file", types[j])
+		})
+
+		for _, t := range types {
+			ids, err := lookupIndex(tx, t, path, ranges)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				rec, err := getRecord(tx, id)
+				if err != nil {
+					return err
+				}
+				if rec == nil {
+					continue
+				}
+				resources = append(resources, newResource(c.host, t, id, rec))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	writePage(w, r, c.host, resources, "")
+}
@@ -0,0 +1,184 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joyrexus/xhub"
+)
+
+// Ensure resources can be looked up by the values of indexed paths, and
+// that indexes are kept up to date as resources change.
+func TestLookup(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	put := func(path, doc string) {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	// Resources stored before indexes are declared get indexed when the
+	// indexes are built.
+	put("/studies/a", `{"subject":"rat_3"}`)
+	put("/studies/a/trials/t1", `{"subject":"rat_3","weight":9.5,`+
+		`"date":"2018-01-05","tags":["pilot","main"]}`)
+	put("/studies/a/trials/t2", `{"subject":"rat_10","weight":-2,`+
+		`"date":"2018-01-05T12:00:00Z"}`)
+
+	indexes := xhub.Indexes{
+		"trial": {"data.subject", "data.weight", "data.date", "data.tags"},
+		"file":  {"data.subject"},
+	}
+	if err := srv.server.Reindex(indexes); err != nil {
+		t.Fatalf("error building indexes: %v", err)
+	}
+	got, err := srv.server.Indexes()
+	if err != nil || !reflect.DeepEqual(indexes, got) {
+		t.Errorf("want indexes %v, got %v (%v)", indexes, got, err)
+	}
+
+	put("/studies/a/trials/t3", `{"subject":"rat_3","weight":100,`+
+		`"date":"2018-02-01T00:00:00-05:00"}`)
+	put("/studies/a/files/f1", `{"subject":"rat_3"}`)
+	put("/files/a/t2/f2", `{"subject":"rat_10"}`)
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"path=data.subject&value=rat_3", []string{
+			"/studies/a/trials/t1",
+			"/studies/a/trials/t3",
+			"/studies/a/files/f1",
+		}},
+		{"path=data.subject&value=rat_3&resource=file", []string{
+			"/studies/a/files/f1",
+		}},
+		{"path=data.subject&value=rat_4", []string{}},
+		// Values aren't matched by their prefixes.
+		{"path=data.subject&value=rat_1", []string{}},
+		{"path=data.subject&max=rat_1", []string{}},
+		{"path=data.subject&min=rat_1&max=rat_10", []string{
+			"/studies/a/trials/t2",
+			"/files/a/t2/f2",
+		}},
+		{"path=data.tags&value=main", []string{"/studies/a/trials/t1"}},
+		// Numbers are ordered numerically, dates chronologically.
+		{"path=data.weight&value=9.50", []string{"/studies/a/trials/t1"}},
+		{"path=data.weight&min=0", []string{
+			"/studies/a/trials/t1",
+			"/studies/a/trials/t3",
+		}},
+		{"path=data.weight&max=9.5", []string{
+			"/studies/a/trials/t2",
+			"/studies/a/trials/t1",
+		}},
+		{"path=data.weight&min=-5&max=10", []string{
+			"/studies/a/trials/t2",
+			"/studies/a/trials/t1",
+		}},
+		{"path=data.date&value=2018-01-05", []string{"/studies/a/trials/t1"}},
+		{"path=data.date&min=2018-01-05T06:00:00Z", []string{
+			"/studies/a/trials/t2",
+			"/studies/a/trials/t3",
+		}},
+		{"path=data.subject&min=rat_2", []string{
+			"/studies/a/trials/t1",
+			"/studies/a/trials/t3",
+			"/studies/a/files/f1",
+		}},
+	} {
+		got := lookup(t, srv.addr, tt.query)
+		if !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("lookup %s: want %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	// Index entries follow updates, deletes, and restores.
+	put("/studies/a/trials/t1", `{"subject":"rat_4"}`)
+	header := map[string]string{"Content-Type": "application/merge-patch+json"}
+	res := sendWith(t, "PATCH", srv.addr+"/studies/a/trials/t3", header,
+		strings.NewReader(`{"subject":"rat_4"}`))
+	res.Body.Close()
+	query := "path=data.subject&value=rat_4"
+	want := []string{"/studies/a/trials/t1", "/studies/a/trials/t3"}
+	if got := lookup(t, srv.addr, query); !reflect.DeepEqual(want, got) {
+		t.Errorf("after update: want %v, got %v", want, got)
+	}
+	rat3 := "path=data.subject&value=rat_3"
+	want = []string{"/studies/a/files/f1"}
+	if got := lookup(t, srv.addr, rat3); !reflect.DeepEqual(want, got) {
+		t.Errorf("after update: want %v, got %v", want, got)
+	}
+
+	status(t, "DELETE", srv.addr+"/studies/a/trials/t3")
+	want = []string{"/studies/a/trials/t1"}
+	if got := lookup(t, srv.addr, query); !reflect.DeepEqual(want, got) {
+		t.Errorf("after delete: want %v, got %v", want, got)
+	}
+	status(t, "POST", srv.addr+"/trash/studies/a/trials/t3/restore")
+	want = []string{"/studies/a/trials/t1", "/studies/a/trials/t3"}
+	if got := lookup(t, srv.addr, query); !reflect.DeepEqual(want, got) {
+		t.Errorf("after restore: want %v, got %v", want, got)
+	}
+
+	// Dropping an index drops its entries.
+	indexes = xhub.Indexes{"file": {"data.subject"}}
+	if err := srv.server.Reindex(indexes); err != nil {
+		t.Fatalf("error rebuilding indexes: %v", err)
+	}
+	want = []string{"/studies/a/files/f1"}
+	if got := lookup(t, srv.addr, rat3); !reflect.DeepEqual(want, got) {
+		t.Errorf("after reindex: want %v, got %v", want, got)
+	}
+
+	for _, query := range []string{
+		"path=data.weight&value=1",
+		"path=data.subject",
+		"path=subject&value=rat_3",
+		"path=data.subject&value=rat_3&resource=trials",
+	} {
+		url := srv.addr + "/lookup?" + query
+		got := status(t, "GET", url)
+		if want := http.StatusBadRequest; want != got {
+			t.Errorf("lookup %s: want %d, got %d", query, want, got)
+		}
+	}
+
+	for _, idx := range []xhub.Indexes{
+		{"trials": {"data.subject"}},
+		{"trial": {"subject"}},
+		{"trial": {"data.a/b"}},
+	} {
+		if err := srv.server.Reindex(idx); err == nil {
+			t.Errorf("want error declaring indexes %v", idx)
+		}
+	}
+}
+
+// lookup looks up resources with the given query, returning their ids.
+func lookup(t *testing.T, addr, query string) []string {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("invalid query %q: %v", query, err)
+	}
+	res := send(t, "GET", addr+"/lookup?"+q.Encode(), nil)
+	defer res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Fatalf("lookup %s: want %d, got %d", query, want, got)
+	}
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatalf("error decoding lookup %s: %v", query, err)
+	}
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
@@ -0,0 +1,281 @@
+package xhub
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errReadOnly is returned when writing within a read-only transaction.
+var errReadOnly = errors.New("transaction is read-only")
+
+// NewMemStore returns an empty in-memory store.  Its contents are lost
+// when the process exits, so it's mainly useful for tests and ephemeral
+// servers (e.g., demos).
+func NewMemStore() *MemStore {
+	return &MemStore{bux: make(memBuckets)}
+}
+
+// A MemStore is a Store holding its items in memory.
+//
+// Transactions are serialized: an update works on a copy of the store's
+// buckets, which replaces the original only if the update succeeds.
+type MemStore struct {
+	mu  sync.RWMutex
+	bux memBuckets
+}
+
+// memBuckets maps bucket names to buckets, which map keys to values.
+// Stored values are never modified, so copies of a memBuckets may share
+// them.
+type memBuckets map[string]map[string][]byte
+
+// View calls fn with a read-only transaction.
+func (s *MemStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memTx{s.bux, false})
+}
+
+// Update calls fn with a read-write transaction.
+func (s *MemStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bux := make(memBuckets, len(s.bux))
+	for name, bk := range s.bux {
+		copied := make(map[string][]byte, len(bk))
+		for k, v := range bk {
+			copied[k] = v
+		}
+		bux[name] = copied
+	}
+	if err := fn(&memTx{bux, true}); err != nil {
+		return err
+	}
+	s.bux = bux
+	return nil
+}
+
+// Get returns the value stored under key in bucket.
+func (s *MemStore) Get(bucket, key []byte) (value []byte, err error) {
+	err = s.View(func(tx Tx) error {
+		value, err = tx.Get(bucket, key)
+		return err
+	})
+	return value, err
+}
+
+// Put stores value under key in bucket.
+func (s *MemStore) Put(bucket, key, value []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+// Delete removes key from bucket.
+func (s *MemStore) Delete(bucket, key []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+// Children returns the items in bucket that are direct children of parent,
+// in key order.
+func (s *MemStore) Children(bucket, parent []byte) (items []Item,
+	err error) {
+
+	err = s.View(func(tx Tx) error {
+		items, err = tx.Children(bucket, parent)
+		return err
+	})
+	return items, err
+}
+
+// EachChild calls fn for each item in bucket that is a direct child of
+// parent, within a single read-only transaction.
+func (s *MemStore) EachChild(bucket, parent []byte,
+	fn func(Item) error) error {
+
+	return s.View(func(tx Tx) error {
+		return tx.EachChild(bucket, parent, fn)
+	})
+}
+
+// EachRange calls fn for each item in bucket with a key from from up to
+// to, within a single read-only transaction.
+func (s *MemStore) EachRange(bucket, from, to []byte,
+	fn func(Item) error) error {
+
+	return s.View(func(tx Tx) error {
+		return tx.EachRange(bucket, from, to, fn)
+	})
+}
+
+// DeleteTree removes root and all of its descendants from bucket,
+// returning the items removed.
+func (s *MemStore) DeleteTree(bucket, root []byte) (items []Item,
+	err error) {
+
+	err = s.Update(func(tx Tx) error {
+		items, err = tx.DeleteTree(bucket, root)
+		return err
+	})
+	return items, err
+}
+
+// Items returns all items in bucket, in key order.
+func (s *MemStore) Items(bucket []byte) (items []Item, err error) {
+	err = s.View(func(tx Tx) error {
+		items, err = tx.Items(bucket)
+		return err
+	})
+	return items, err
+}
+
+// Close is a no-op for in-memory stores.
+func (s *MemStore) Close() error {
+	return nil
+}
+
+// A memTx is a transaction on the buckets of a MemStore.
+type memTx struct {
+	bux      memBuckets
+	writable bool
+}
+
+// Get returns the value stored under key in bucket.
+func (t *memTx) Get(bucket, key []byte) ([]byte, error) {
+	v, ok := t.bux[string(bucket)][string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return clone(v), nil
+}
+
+// Put stores value under key in bucket.
+func (t *memTx) Put(bucket, key, value []byte) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	bk, ok := t.bux[string(bucket)]
+	if !ok {
+		bk = make(map[string][]byte)
+		t.bux[string(bucket)] = bk
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	bk[string(key)] = clone(value)
+	return nil
+}
+
+// Delete removes key from bucket.
+func (t *memTx) Delete(bucket, key []byte) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	delete(t.bux[string(bucket)], string(key))
+	return nil
+}
+
+// Children returns the items in bucket that are direct children of parent,
+// in key order.
+func (t *memTx) Children(bucket, parent []byte) ([]Item, error) {
+	prefix := descendantPrefix(parent)
+	items := []Item{}
+	for k, v := range t.bux[string(bucket)] {
+		key := []byte(k)
+		if bytes.HasPrefix(key, prefix) && isChild(prefix, key) {
+			items = append(items, Item{key, clone(v)})
+		}
+	}
+	sortItems(items)
+	return items, nil
+}
+
+// EachChild calls fn for each item in bucket that is a direct child of
+// parent.  As buckets are unordered, the children are gathered and sorted
+// first.
+func (t *memTx) EachChild(bucket, parent []byte, fn func(Item) error) error {
+	items, err := t.Children(bucket, parent)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachRange calls fn for each item in bucket with a key from from up to
+// to.  As buckets are unordered, the items in range are gathered and
+// sorted first.
+func (t *memTx) EachRange(bucket, from, to []byte, fn func(Item) error) error {
+	var items []Item
+	for k, v := range t.bux[string(bucket)] {
+		key := []byte(k)
+		if bytes.Compare(key, from) >= 0 &&
+			(to == nil || bytes.Compare(key, to) < 0) {
+			items = append(items, Item{key, clone(v)})
+		}
+	}
+	sortItems(items)
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTree removes root and all of its descendants from bucket,
+// returning the items removed.
+func (t *memTx) DeleteTree(bucket, root []byte) ([]Item, error) {
+	if !t.writable {
+		return nil, errReadOnly
+	}
+	prefix := descendantPrefix(root)
+	bk := t.bux[string(bucket)]
+	var items []Item
+	for k, v := range bk {
+		key := []byte(k)
+		if bytes.Equal(key, root) || bytes.HasPrefix(key, prefix) {
+			items = append(items, Item{key, v})
+			delete(bk, k)
+		}
+	}
+	sortItems(items)
+	return items, nil
+}
+
+// Items returns all items in bucket, in key order.
+func (t *memTx) Items(bucket []byte) ([]Item, error) {
+	items := []Item{}
+	for k, v := range t.bux[string(bucket)] {
+		items = append(items, Item{[]byte(k), clone(v)})
+	}
+	sortItems(items)
+	return items, nil
+}
+
+// sortItems sorts items by key.
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return bytes.Compare(items[i].Key, items[j].Key) < 0
+	})
+}
+
+// clone returns a copy of b, so that callers never share a stored slice.
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
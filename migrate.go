@@ -0,0 +1,209 @@
+package xhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// A migration upgrades the contents of a store from one version of our
+// storage layout to the next, within a transaction.
+type migration struct {
+	desc string
+	run  func(Tx) error
+}
+
+// migrations lists the upgrades applied to a store, in order.  A store at
+// layout version N has had the first N migrations applied to it, so new
+// migrations must only ever be appended.
+var migrations = []migration{
+	{
+		"drop studylist entries orphaned by prefix-matching deletes",
+		dropOrphanedStudies,
+	},
+	{
+		"wrap stored data payloads in revision records",
+		wrapRecords,
+	},
+	{
+		"record the creation times of studies in their records",
+		stampStudies,
+	},
+	{
+		"seed revision histories with current records",
+		seedHistory,
+	},
+	{
+		"build the search index",
+		buildSearchIndex,
+	},
+}
+
+// schemaKey is the key in the meta bucket holding a store's layout version.
+var schemaKey = []byte("schema")
+
+// Migrate brings the contents of store up to the current storage layout,
+// applying each pending migration once.  Each migration is applied in the
+// same transaction as the update of the layout version, so a migration
+// that fails (or is interrupted) is rolled back and applied again later.
+func Migrate(store Store) error {
+	version, err := schemaVersion(store)
+	if err != nil {
+		return err
+	}
+	for version < len(migrations) {
+		m := migrations[version]
+		if verbose {
+			log.Printf("migrating store to version %d: %s\n", version+1, m.desc)
+		}
+		v := []byte(strconv.Itoa(version + 1))
+		err := store.Update(func(tx Tx) error {
+			if err := m.run(tx); err != nil {
+				return err
+			}
+			return tx.Put(metaBucket, schemaKey, v)
+		})
+		if err != nil {
+			return fmt.Errorf("migration to version %d failed: %v",
+				version+1,
+				err,
+			)
+		}
+		version++
+	}
+	return nil
+}
+
+// schemaVersion returns the layout version of store, where zero means no
+// migrations have been applied.
+func schemaVersion(store Store) (int, error) {
+	v, err := store.Get(metaBucket, schemaKey)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %v", v, err)
+	}
+	return version, nil
+}
+
+// dropOrphanedStudies removes studylist entries that no longer refer to a
+// reachable study.
+//
+// Deletes used to match on raw key prefixes, so deleting study "a" also
+// deleted the data of study "ab" (along with its trials and files) while
+// leaving its studylist entry behind.  Likewise, studies posted with ids
+// outside of `/studies/:study` were listed but could never be retrieved.
+// The lost data can't be recovered, but the dangling entries can be dropped.
+func dropOrphanedStudies(tx Tx) error {
+	items, err := tx.Items(studylistBucket)
+	if err != nil {
+		return err
+	}
+	parent := []byte("/studies")
+	prefix := descendantPrefix(parent)
+	for _, item := range items {
+		if bytes.HasPrefix(item.Key, prefix) && isChild(prefix, item.Key) {
+			data, err := tx.Get(studiesBucket, item.Key)
+			if err != nil {
+				return err
+			}
+			if data != nil {
+				continue
+			}
+		}
+		if err := tx.Delete(studylistBucket, item.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapRecords wraps each data payload in the studies bucket in a record,
+// as its first revision.  Payloads used to be stored as is, and resources
+// posted without one were stored with an empty value, which is wrapped as
+// a null payload.
+func wrapRecords(tx Tx) error {
+	items, err := tx.Items(studiesBucket)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		rec := &record{Rev: 1, Data: item.Value}
+		if len(rec.Data) == 0 {
+			rec.Data = json.RawMessage("null")
+		}
+		if err := storeRecord(tx, string(item.Key), rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stampStudies copies the creation time of each study from the studylist
+// bucket into the study's record.  Creation times used to be kept in the
+// studylist bucket alone, and only for studies.
+func stampStudies(tx Tx) error {
+	items, err := tx.Items(studylistBucket)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		id := string(item.Key)
+		rec, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Created != "" {
+			continue
+		}
+		rec.Created = string(item.Value)
+		rec.Modified = rec.Created
+		if err := storeRecord(tx, id, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedHistory adds the current record of each resource to its revision
+// history.  Revisions used to be overwritten without keeping a history.
+func seedHistory(tx Tx) error {
+	items, err := tx.Items(studiesBucket)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		rec, err := decodeRecord(item.Value)
+		if err != nil {
+			return err
+		}
+		if err := appendHistory(tx, string(item.Key), rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildSearchIndex adds each resource to the search index, which used to
+// be missing.
+func buildSearchIndex(tx Tx) error {
+	items, err := tx.Items(studiesBucket)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		rec, err := decodeRecord(item.Value)
+		if err != nil {
+			return err
+		}
+		err = updateSearch(tx, string(item.Key), nil, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
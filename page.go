@@ -0,0 +1,229 @@
+package xhub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A page describes the part of a collection requested by a list request,
+// via its limit, after, and sort query parameters.
+type page struct {
+	limit int    // maximum number of resources listed, or 0 for all
+	after string // id of the resource preceding the page
+	sort  string // sort order: "id", "created", or "natural"
+}
+
+// A listing is a resource of a collection being listed.
+type listing struct {
+	id      string
+	created time.Time // creation time, only needed when sorting by it
+	rec     *record   // stored record, if at hand
+}
+
+// createdTime parses the creation time of a resource, as recorded in its
+// record or in the studylist bucket.  Missing or invalid times are zero,
+// so that their resources sort first.
+func createdTime(created string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, created)
+	return t
+}
+
+// pageParam returns the page requested by r.  By default, a list includes
+// all of a collection's resources, ordered by id.
+func pageParam(r *http.Request) (*page, error) {
+	q := r.URL.Query()
+	p := &page{after: q.Get("after"), sort: q.Get("sort")}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid limit parameter %q: expecting "+
+				"a positive integer", v)
+		}
+		p.limit = limit
+	}
+	switch p.sort {
+	case "":
+		p.sort = "id"
+	case "id", "created", "natural":
+	default:
+		return nil, fmt.Errorf("invalid sort parameter %q: expecting id, "+
+			"created, or natural", p.sort)
+	}
+	return p, nil
+}
+
+// apply sorts the listings of a collection, returning the ones on the page
+// along with whether more follow.  A page following a resource that's no
+// longer listed picks up where that resource would have been, unless the
+// listings are sorted by creation time, in which case the request fails.
+func (p *page) apply(listings []listing) ([]listing, bool, error) {
+	var less func(a, b *listing) bool
+	switch p.sort {
+	case "id":
+		less = func(a, b *listing) bool { return a.id < b.id }
+	case "natural":
+		less = func(a, b *listing) bool { return naturalLess(a.id, b.id) }
+	case "created":
+		less = func(a, b *listing) bool {
+			if !a.created.Equal(b.created) {
+				return a.created.Before(b.created)
+			}
+			return a.id < b.id
+		}
+	}
+	sort.SliceStable(listings, func(i, j int) bool {
+		return less(&listings[i], &listings[j])
+	})
+
+	if p.after != "" {
+		start := -1
+		for i := range listings {
+			if listings[i].id == p.after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 && p.sort == "created" {
+			return nil, false, errorf(http.StatusBadRequest,
+				"can't list resources after %s: it's no longer listed",
+				p.after)
+		}
+		if start < 0 {
+			after := &listing{id: p.after}
+			start = sort.Search(len(listings), func(i int) bool {
+				return less(after, &listings[i])
+			})
+		}
+		listings = listings[start:]
+	}
+	if p.limit > 0 && len(listings) > p.limit {
+		return listings[:p.limit], true, nil
+	}
+	return listings, false, nil
+}
+
+// errPageFull stops the iteration over a collection once a page is full.
+var errPageFull = errors.New("page is full")
+
+// list returns the listings of the resources in the collection at parent
+// matching where, as on the page (see apply), along with whether more
+// follow.  Pages ordered by id are read in key order, seeking to the
+// resource they follow and stopping once full, while other orders need
+// the whole collection sorted first.
+func (p *page) list(tx Tx, parent string, where filter) ([]listing, bool,
+	error) {
+
+	prefix := descendantPrefix([]byte(parent))
+	listings := []listing{}
+	more := false
+	add := func(item Item) error {
+		if !isChild(prefix, item.Key) {
+			return nil
+		}
+		rec, err := decodeRecord(item.Value)
+		if err != nil {
+			return err
+		}
+		if ok, err := where.match(rec); !ok || err != nil {
+			return err
+		}
+		if p.sort == "id" && p.limit > 0 && len(listings) == p.limit {
+			more = true
+			return errPageFull
+		}
+		listings = append(listings, listing{string(item.Key),
+			createdTime(rec.Created), rec})
+		return nil
+	}
+
+	if p.sort != "id" {
+		err := tx.EachChild(studiesBucket, []byte(parent), add)
+		if err != nil {
+			return nil, false, err
+		}
+		return p.apply(listings)
+	}
+	from := prefix
+	if after := []byte(p.after); bytes.Compare(after, prefix) > 0 {
+		from = append(after, 0) // the least key following after
+	}
+	// Descendants of parent sort before the prefix with its separator
+	// replaced by the byte following it.
+	to := append(prefix[:len(prefix)-1:len(prefix)-1], '/'+1)
+	err := tx.EachRange(studiesBucket, from, to, add)
+	if err != nil && err != errPageFull {
+		return nil, false, err
+	}
+	return listings, more, nil
+}
+
+// setNext sets a Link header in the response to r referring to the page
+// following the one ending with the resource last.
+func setNext(w http.ResponseWriter, r *http.Request, host, last string) {
+	q := r.URL.Query()
+	q.Set("after", last)
+	next := url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: q.Encode(),
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+}
+
+// naturalLess reports whether the string a sorts before b in natural
+// order, where runs of digits are compared by their numeric value (so that
+// "trial_2" sorts before "trial_10").  Strings equal in natural order are
+// ordered bytewise.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			// Compare the runs of digits, ignoring leading zeros.
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			x, y := trimZeros(a[si:i]), trimZeros(b[sj:j])
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			if x != y {
+				return x < y
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+// isDigit reports whether the byte c is an ascii digit.
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// trimZeros trims the leading zeros from a run of digits, leaving at least
+// one digit.
+func trimZeros(digits string) string {
+	for len(digits) > 1 && digits[0] == '0' {
+		digits = digits[1:]
+	}
+	return digits
+}
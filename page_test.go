@@ -0,0 +1,154 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joyrexus/xhub"
+)
+
+// Ensure lists can be sorted and paginated, following Link headers.
+func TestPagination(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	// Trials are created out of natural order.
+	trials := []string{"trial_2", "trial_10", "trial_1", "trial_03"}
+	for _, trial := range trials {
+		path := "/studies/a/trials/" + trial
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(`{}`))
+		res.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"trial_03", "trial_1", "trial_10", "trial_2"}},
+		{"?sort=id", []string{"trial_03", "trial_1", "trial_10", "trial_2"}},
+		{"?sort=natural", []string{"trial_1", "trial_2", "trial_03", "trial_10"}},
+		{"?sort=created", []string{"trial_2", "trial_10", "trial_1", "trial_03"}},
+	} {
+		url := srv.addr + "/studies/a/trials" + tt.query
+		if got := listPages(t, url, 0); !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("list%s: want %v, got %v", tt.query, tt.want, got)
+		}
+		for _, limit := range []string{"1", "3", "4"} {
+			query := "?limit=" + limit
+			if tt.query != "" {
+				query = tt.query + "&limit=" + limit
+			}
+			url := srv.addr + "/studies/a/trials" + query
+			if got := listPages(t, url, 0); !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("list%s: want %v, got %v", query, tt.want, got)
+			}
+		}
+	}
+
+	// A page can follow a resource that has since been deleted.
+	url := srv.addr + "/studies/a/trials?sort=natural" +
+		"&after=/studies/a/trials/trial_2"
+	status(t, "DELETE", srv.addr+"/studies/a/trials/trial_2")
+	want := []string{"trial_03", "trial_10"}
+	if got := listPages(t, url, 0); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// Studies are paginated too.
+	for _, study := range []string{"a", "b", "c"} {
+		url := srv.addr + "/studies/" + study
+		res := send(t, "PUT", url, strings.NewReader(`{}`))
+		res.Body.Close()
+	}
+	want = []string{"a", "b", "c"}
+	url = srv.addr + "/studies?limit=2"
+	if got := listPages(t, url, 2); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for _, query := range []string{
+		"?limit=0",
+		"?limit=x",
+		"?sort=size",
+		"?sort=created&after=/studies/a/trials/trial_2",
+	} {
+		url := srv.addr + "/studies/a/trials" + query
+		if want, got := http.StatusBadRequest, status(t, "GET", url); want != got {
+			t.Errorf("GET %s: want %d, got %d", query, want, got)
+		}
+	}
+}
+
+// Ensure lists sorted by creation time compare the times, rather than
+// their text, which drops trailing zeros from fractional seconds.
+func TestSortCreated(t *testing.T) {
+	store := xhub.NewMemStore()
+	srv := httptest.NewServer(xhub.NewServerWithStore("localhost:8081",
+		store))
+	defer srv.Close()
+
+	for id, created := range map[string]string{
+		"/studies/a":           "2020-01-01T00:00:00Z",
+		"/studies/a/trials/t1": "2020-01-01T00:00:05Z",
+		"/studies/a/trials/t2": "2020-01-01T00:00:05.5Z",
+		"/studies/a/trials/t3": "2020-01-01T00:00:05.25Z",
+	} {
+		rec := `{"rev":1,"created":"` + created + `","data":{}}`
+		if err := store.Put([]byte("studies"), []byte(id),
+			[]byte(rec)); err != nil {
+			t.Fatalf("error putting %s: %v", id, err)
+		}
+	}
+	want := []string{"t1", "t3", "t2"}
+	url := srv.URL + "/studies/a/trials?sort=created&limit=2"
+	if got := listPages(t, url, 2); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// listPages lists the resources at url, following the Link headers to
+// each next page, and returns the names of the resources listed.  If pages
+// is non-zero, the resources must be listed on that many pages.
+func listPages(t *testing.T, url string, pages int) []string {
+	names := []string{}
+	n := 0
+	for url != "" {
+		res := send(t, "GET", url, nil)
+		var items []Item
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatalf("error decoding %s: %v", url, err)
+		}
+		res.Body.Close()
+		for _, item := range items {
+			names = append(names, item.ID[strings.LastIndex(item.ID, "/")+1:])
+		}
+		n++
+
+		url = ""
+		link := res.Header.Get("Link")
+		if link != "" {
+			if !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("unexpected Link header %q", link)
+			}
+			// Links refer to the server's configured address.
+			next := strings.TrimSuffix(link[1:], `>; rel="next"`)
+			url = strings.Replace(next, "http://localhost:8081", srvAddr(res), 1)
+		}
+		if n > 10 {
+			t.Fatalf("too many pages listing %s", url)
+		}
+	}
+	if pages != 0 && pages != n {
+		t.Errorf("want %d pages, got %d", pages, n)
+	}
+	return names
+}
+
+// srvAddr returns the address of the server that sent res.
+func srvAddr(res *http.Response) string {
+	return "http://" + res.Request.URL.Host
+}
@@ -0,0 +1,476 @@
+package xhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types of the patch documents accepted by PATCH handlers.
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7386
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// decodeJSON decodes a json document, preserving the precision of numbers.
+func decodeJSON(data []byte) (interface{}, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after json document")
+	}
+	return doc, nil
+}
+
+/* -- JSON MERGE PATCH -- */
+
+// mergePatch applies the json merge patch (RFC 7386) to doc, returning the
+// patched document.
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = make(map[string]interface{})
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(target, name)
+		} else {
+			target[name] = mergePatch(target[name], value)
+		}
+	}
+	return target
+}
+
+/* -- JSON PATCH -- */
+
+// A patchOp is a single operation of a json patch document.
+type patchOp struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+
+	value interface{} // decoded Value
+}
+
+// A jsonPatch is a sequence of operations, as described in RFC 6902.
+type jsonPatch []*patchOp
+
+// parseJSONPatch parses a json patch document, checking that each of its
+// operations is well-formed.
+func parseJSONPatch(data []byte) (jsonPatch, error) {
+	var patch jsonPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	for i, op := range patch {
+		if op == nil {
+			return nil, fmt.Errorf("operation %d is null", i)
+		}
+		switch op.Op {
+		case "add", "remove", "replace", "move", "copy", "test":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+		if op.Path == nil {
+			return nil, fmt.Errorf("operation %d: missing path", i)
+		}
+		if _, err := parsePointer(*op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+		switch op.Op {
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("operation %d: missing from", i)
+			}
+			if _, err := parsePointer(*op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: %v", i, err)
+			}
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: missing value", i)
+			}
+			v, err := decodeJSON(*op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %v", i, err)
+			}
+			op.value = v
+		}
+	}
+	return patch, nil
+}
+
+// apply applies each operation of the patch to doc in turn, returning the
+// patched document.  If any operation fails, the patch as a whole fails.
+func (patch jsonPatch) apply(doc interface{}) (interface{}, error) {
+	var err error
+	for i, op := range patch {
+		path, _ := parsePointer(*op.Path)
+		switch op.Op {
+		case "add":
+			doc, err = addValue(doc, path, deepCopy(op.value))
+		case "remove":
+			doc, _, err = removeValue(doc, path)
+		case "replace":
+			if doc, _, err = removeValue(doc, path); err == nil {
+				doc, err = addValue(doc, path, deepCopy(op.value))
+			}
+		case "move":
+			from, _ := parsePointer(*op.From)
+			if isProperPrefix(from, path) {
+				err = fmt.Errorf("can't move %s into itself", *op.From)
+				break
+			}
+			var v interface{}
+			if doc, v, err = removeValue(doc, from); err == nil {
+				doc, err = addValue(doc, path, v)
+			}
+		case "copy":
+			from, _ := parsePointer(*op.From)
+			var v interface{}
+			if v, err = getValue(doc, from); err == nil {
+				doc, err = addValue(doc, path, deepCopy(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = getValue(doc, path); err == nil && !jsonEqual(v, op.value) {
+				err = fmt.Errorf("value at %q doesn't match", *op.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %v", i, op.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a json pointer (RFC 6901) into its reference tokens.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		t = strings.Replace(t, "~1", "/", -1)
+		tokens[i] = strings.Replace(t, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// formatPointer appends the reference token to the json pointer ptr,
+// escaping it as needed.
+func formatPointer(ptr, token string) string {
+	token = strings.Replace(token, "~", "~0", -1)
+	return ptr + "/" + strings.Replace(token, "/", "~1", -1)
+}
+
+// isProperPrefix reports whether the pointer tokens a are a proper prefix
+// of the pointer tokens b.
+func isProperPrefix(a, b []string) bool {
+	if len(a) >= len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses the token as an index into an array of length n.
+// If end is true, the index may refer to the end of the array (i.e., be n
+// or "-").
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// getValue returns the value at path in doc.
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("can't reference %q in a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// updateParent calls fn with the container holding the value at path
+// (which must be non-empty) and the final token of path, replacing that
+// container with the one fn returns.  It returns the updated document.
+func updateParent(doc interface{}, path []string,
+	fn func(parent interface{}, token string) (interface{}, error),
+) (interface{}, error) {
+
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := getValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateParent(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(node), false)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+// addValue adds v at path in doc, as described for the "add" operation.
+func addValue(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return updateParent(doc, path,
+		func(parent interface{}, token string) (interface{}, error) {
+			switch node := parent.(type) {
+			case map[string]interface{}:
+				node[token] = v
+				return node, nil
+			case []interface{}:
+				i, err := arrayIndex(token, len(node), true)
+				if err != nil {
+					return nil, err
+				}
+				node = append(node, nil)
+				copy(node[i+1:], node[i:])
+				node[i] = v
+				return node, nil
+			}
+			return nil, fmt.Errorf("can't add %q to a scalar", token)
+		},
+	)
+}
+
+// removeValue removes the value at path from doc, returning the updated
+// document and the removed value.
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	var removed interface{}
+	doc, err := updateParent(doc, path,
+		func(parent interface{}, token string) (interface{}, error) {
+			switch node := parent.(type) {
+			case map[string]interface{}:
+				v, ok := node[token]
+				if !ok {
+					return nil, fmt.Errorf("member %q not found", token)
+				}
+				removed = v
+				delete(node, token)
+				return node, nil
+			case []interface{}:
+				i, err := arrayIndex(token, len(node), false)
+				if err != nil {
+					return nil, err
+				}
+				removed = node[i]
+				return append(node[:i], node[i+1:]...), nil
+			}
+			return nil, fmt.Errorf("can't remove %q from a scalar", token)
+		},
+	)
+	return doc, removed, err
+}
+
+// deepCopy returns a copy of the decoded json value v sharing no maps or
+// slices with it.
+func deepCopy(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(node))
+		for i, v := range node {
+			a[i] = deepCopy(v)
+		}
+		return a
+	}
+	return v
+}
+
+// jsonEqual reports whether the decoded json values a and b are equal,
+// comparing numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+/* -- DIFF -- */
+
+// diffJSON returns a json patch transforming the decoded json document a
+// into the document b.  Objects and arrays present in both are compared
+// member by member, so that the patch only touches the values changed.
+func diffJSON(a, b interface{}) (jsonPatch, error) {
+	patch := jsonPatch{}
+	if err := patch.diff("", a, b); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// diff appends the operations transforming the value a at the json
+// pointer path into the value b.
+func (patch *jsonPatch) diff(path string, a, b interface{}) error {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, k := range sortedKeys(x) {
+			if _, ok := y[k]; !ok {
+				patch.add("remove", formatPointer(path, k), nil)
+			}
+		}
+		for _, k := range sortedKeys(y) {
+			var err error
+			if v, ok := x[k]; ok {
+				err = patch.diff(formatPointer(path, k), v, y[k])
+			} else {
+				err = patch.add("add", formatPointer(path, k), y[k])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		elem := func(i int) string {
+			return formatPointer(path, strconv.Itoa(i))
+		}
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if err := patch.diff(elem(i), x[i], y[i]); err != nil {
+				return err
+			}
+		}
+		for i := len(x) - 1; i >= len(y); i-- {
+			patch.add("remove", elem(i), nil)
+		}
+		for i := len(x); i < len(y); i++ {
+			if err := patch.add("add", elem(i), y[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if jsonEqual(a, b) {
+		return nil
+	}
+	return patch.add("replace", path, b)
+}
+
+// add appends an operation to the patch, setting its value to v unless
+// it's a remove operation.
+func (patch *jsonPatch) add(op, path string, v interface{}) error {
+	o := &patchOp{Op: op, Path: &path}
+	if op != "remove" {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		raw := json.RawMessage(data)
+		o.Value, o.value = &raw, v
+	}
+	*patch = append(*patch, o)
+	return nil
+}
+
+// sortedKeys returns the keys of the json object m, in order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,95 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// A Problem describes an error encountered while handling a request.  It's
+// sent to clients as a json-encoded "problem details" object, as described
+// in RFC 7807.
+type Problem struct {
+	Type     string `json:"type"`               // problem type URI
+	Title    string `json:"title"`              // summary of the problem type
+	Status   int    `json:"status"`             // http status code
+	Detail   string `json:"detail,omitempty"`   // explanation of this problem
+	Instance string `json:"instance,omitempty"` // path of the request
+
+	// Violations lists how a data payload sent fails to match the schema
+	// of its study, for 422 Unprocessable Entity problems.
+	Violations []*Violation `json:"violations,omitempty"`
+}
+
+// writeError responds to r with a problem details object for the given
+// status code and detail message.
+func writeError(w http.ResponseWriter, r *http.Request, status int,
+	detail string) {
+
+	writeProblem(w, r, status, detail, nil)
+}
+
+// writeProblem responds to r with a problem details object for the given
+// status code, detail message, and schema violations (if any).
+func writeProblem(w http.ResponseWriter, r *http.Request, status int,
+	detail string, violations []*Violation) {
+
+	problem := &Problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     detail,
+		Instance:   r.URL.Path,
+		Violations: violations,
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// notFound responds to r with a 404 Not Found problem for the resource id,
+// or with a bare 204 No Content if the config calls for it.
+func (cfg *Config) notFound(w http.ResponseWriter, r *http.Request,
+	id string) {
+
+	if cfg.LegacyNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, r, http.StatusNotFound, id+" not found")
+}
+
+// A statusError is an error to be reported to clients with a particular
+// http status code.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// errorf returns a statusError with the given status code and a message
+// formatted according to format.
+func errorf(status int, format string, a ...interface{}) error {
+	return &statusError{status, fmt.Sprintf(format, a...)}
+}
+
+// fail responds to r with a problem details object describing err.  The
+// response status is the one carried by err if it's a statusError, 422
+// Unprocessable Entity if it's a dataError (listing its violations), and
+// 500 Internal Server Error otherwise.
+func fail(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case *statusError:
+		status = e.status
+	case *dataError:
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error(),
+			e.violations)
+		return
+	}
+	writeError(w, r, status, err.Error())
+}
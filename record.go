@@ -0,0 +1,189 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A record is the stored representation of a resource: the json data
+// payload sent by clients, wrapped in an envelope of metadata maintained
+// by the server.
+type record struct {
+	Rev      int             `json:"rev"`                // revision, incremented on each write
+	Created  string          `json:"created,omitempty"`  // time of first revision
+	Modified string          `json:"modified,omitempty"` // time of latest revision
+	Author   string          `json:"author,omitempty"`   // submitter of first revision
+	Editor   string          `json:"editor,omitempty"`   // submitter of latest revision
+	Data     json.RawMessage `json:"data"`               // client-supplied data payload
+
+	// Inherited lists the paths of the values in a trial's data payload
+	// that were filled in from its study's trial template, rather than
+	// sent by clients (see applyTemplate).
+	Inherited []string `json:"inherited,omitempty"`
+}
+
+// ETag returns the entity tag identifying the record's revision.
+func (rec *record) ETag() string {
+	return strconv.Quote(strconv.Itoa(rec.Rev))
+}
+
+// getRecord returns the record stored for the resource id, or nil if the
+// resource doesn't exist.
+func getRecord(tx Tx, id string) (*record, error) {
+	v, err := tx.Get(studiesBucket, []byte(id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return decodeRecord(v)
+}
+
+// loadRecord returns the record stored in store for the resource id, or
+// nil if the resource doesn't exist.
+func loadRecord(store Store, id string) (rec *record, err error) {
+	err = store.View(func(tx Tx) error {
+		rec, err = getRecord(tx, id)
+		return err
+	})
+	return rec, err
+}
+
+// decodeRecord decodes a stored record.
+func decodeRecord(v []byte) (*record, error) {
+	rec := new(record)
+	if err := json.Unmarshal(v, rec); err != nil {
+		return nil, fmt.Errorf("couldn't decode stored record: %v", err)
+	}
+	return rec, nil
+}
+
+// putRecord stores data as the new revision of the resource id, given its
+// current record (nil if the resource is new) and the user submitting it.
+// The data payload of a trial is first merged over the defaults of its
+// study's trial template (see applyTemplate).  The revision is also
+// appended to the resource's history, and the resource's index entries
+// are updated.  It returns the record stored.
+func putRecord(tx Tx, id string, old *record, data []byte,
+	user string) (*record, error) {
+
+	data, inherited, err := applyTemplate(tx, id, old, data)
+	if err != nil {
+		return nil, err
+	}
+	return putRevision(tx, id, old, data, inherited, user)
+}
+
+// putRevision stores data as the new revision of the resource id, as
+// described for putRecord, recording the inherited paths of the values
+// filled in from its study's trial template.
+func putRevision(tx Tx, id string, old *record, data []byte,
+	inherited []string, user string) (*record, error) {
+
+	if err := checkData(tx, id, data); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	rec := &record{Created: now, Author: user}
+	if old != nil {
+		rec.Rev, rec.Created, rec.Author = old.Rev+1, old.Created, old.Author
+	} else {
+		// A resource recreated after being deleted picks up its revision
+		// numbers where its history left off.
+		last, err := lastRevision(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		rec.Rev = last + 1
+	}
+	rec.Modified, rec.Editor, rec.Data = now, user, data
+	rec.Inherited = inherited
+	if len(rec.Data) == 0 {
+		rec.Data = json.RawMessage("null")
+	}
+	if err := storeRecord(tx, id, rec); err != nil {
+		return nil, err
+	}
+	if err := indexRecord(tx, id, old, rec); err != nil {
+		return nil, err
+	}
+	return rec, appendHistory(tx, id, rec)
+}
+
+// storeRecord stores rec as the record of the resource id.
+func storeRecord(tx Tx, id string, rec *record) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Put(studiesBucket, []byte(id), v)
+}
+
+// author returns the user (or, failing that, the client) submitting r, for
+// attributing the revisions it makes.  This is the user name given with
+// basic authentication, the From header, or the User-Agent header, in that
+// order of preference.  Note that none of these are verified.
+func author(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if from := r.Header.Get("From"); from != "" {
+		return from
+	}
+	return r.UserAgent()
+}
+
+/* -- PRECONDITIONS -- */
+
+// checkPreconditions checks the If-Match header of r (if any) against the
+// current record of the resource id (nil if the resource doesn't exist),
+// returning a 412 Precondition Failed error if it doesn't match.
+func checkPreconditions(r *http.Request, id string, rec *record) error {
+	return checkMatch(r.Header.Get("If-Match"), id, rec)
+}
+
+// checkMatch checks the entity tags listed in match, as in an If-Match
+// header, against the current record of the resource id.  An empty match
+// always succeeds.
+func checkMatch(match, id string, rec *record) error {
+	if match == "" {
+		return nil
+	}
+	if rec != nil && etagsMatch(match, rec.ETag(), false) {
+		return nil
+	}
+	return errorf(http.StatusPreconditionFailed,
+		"%s has changed (or no longer exists) since it was retrieved", id)
+}
+
+// notModified reports whether the If-None-Match header of r matches etag,
+// meaning the client already has the current representation.
+func notModified(r *http.Request, etag string) bool {
+	match := r.Header.Get("If-None-Match")
+	return match != "" && etagsMatch(match, etag, true)
+}
+
+// etagsMatch reports whether etag matches the list of entity tags in an
+// If-Match or If-None-Match header value.  Weak tags only match if weak
+// comparison is requested, as it is for If-None-Match.
+func etagsMatch(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	strip := func(tag string) (string, bool) {
+		if strings.HasPrefix(tag, "W/") {
+			return tag[2:], true
+		}
+		return tag, false
+	}
+	etag, etagWeak := strip(etag)
+	for _, tag := range strings.Split(header, ",") {
+		tag, tagWeak := strip(strings.TrimSpace(tag))
+		if tag == etag && (weak || !(tagWeak || etagWeak)) {
+			return true
+		}
+	}
+	return false
+}
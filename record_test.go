@@ -0,0 +1,194 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure resources are tagged with their revision, and conditional GETs
+// are answered with 304 Not Modified while the tag still matches.
+func TestETags(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	url := srv.addr + "/studies/test_study/trials/test_trial"
+	for i, want := range []string{`"1"`, `"2"`} {
+		res := send(t, "PUT", url, strings.NewReader(`{"n":1}`))
+		res.Body.Close()
+		if got := res.Header.Get("ETag"); want != got {
+			t.Errorf("PUT %d: want ETag %s, got %s", i+1, want, got)
+		}
+	}
+
+	res := send(t, "GET", url, nil)
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if want := `"2"`; want != etag {
+		t.Errorf("GET: want ETag %s, got %s", want, etag)
+	}
+
+	header := map[string]string{"If-None-Match": etag}
+	res = sendWith(t, "GET", url, header, nil)
+	res.Body.Close()
+	if want, got := http.StatusNotModified, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	header["If-None-Match"] = `"1"`
+	res = sendWith(t, "GET", url, header, nil)
+	res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+
+	// Lists are tagged too, and the tag changes with the list.
+	list := srv.addr + "/studies/test_study/trials"
+	res = send(t, "GET", list, nil)
+	res.Body.Close()
+	etag = res.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("want weak list ETag, got %q", etag)
+	}
+	header["If-None-Match"] = etag
+	res = sendWith(t, "GET", list, header, nil)
+	res.Body.Close()
+	if want, got := http.StatusNotModified, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	res = send(t, "PUT", url, strings.NewReader(`{"n":2}`))
+	res.Body.Close()
+	res = sendWith(t, "GET", list, header, nil)
+	res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+// Ensure writes carrying a stale If-Match tag are refused.
+func TestIfMatch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	url := srv.addr + "/studies/test_study/files/test_file"
+	res := send(t, "PUT", url, strings.NewReader(`{"n":1}`))
+	res.Body.Close()
+	stale := res.Header.Get("ETag")
+	res = send(t, "PUT", url, strings.NewReader(`{"n":2}`))
+	res.Body.Close()
+	current := res.Header.Get("ETag")
+
+	for _, tt := range []struct {
+		method, etag, ctype, body string
+		status                    int
+	}{
+		{"PUT", stale, "", `{"n":3}`, http.StatusPreconditionFailed},
+		{"PATCH", stale, "application/merge-patch+json", `{"n":3}`,
+			http.StatusPreconditionFailed},
+		{"DELETE", stale, "", "", http.StatusPreconditionFailed},
+		{"PATCH", current, "application/merge-patch+json", `{"n":3}`,
+			http.StatusOK},
+		{"PUT", `"3"`, "", `{"n":4}`, http.StatusOK},
+		{"DELETE", `"4"`, "", "", http.StatusOK},
+		{"PUT", "*", "", `{"n":5}`, http.StatusPreconditionFailed},
+	} {
+		header := map[string]string{"If-Match": tt.etag}
+		if tt.ctype != "" {
+			header["Content-Type"] = tt.ctype
+		}
+		res := sendWith(t, tt.method, url, header, strings.NewReader(tt.body))
+		res.Body.Close()
+		if want, got := tt.status, res.StatusCode; want != got {
+			t.Errorf("%s with If-Match %s: want %d, got %d",
+				tt.method, tt.etag, want, got)
+		}
+	}
+
+	// The file was deleted, so nothing was created by the last PUT.
+	if want, got := http.StatusNotFound, status(t, "GET", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+// Ensure resources record when and by whom they were created and last
+// modified, and that this metadata is listed and retrievable.
+func TestMetadata(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	study := srv.addr + "/studies/test_study"
+	for _, path := range []string{
+		"/studies/test_study",
+		"/studies/test_study/trials/test_trial",
+		"/studies/test_study/files/test_file",
+		"/files/test_study/test_trial/test_file",
+	} {
+		url := srv.addr + path
+		header := map[string]string{"From": "ann@example.com"}
+		res := sendWith(t, "PUT", url, header, strings.NewReader(`{}`))
+		res.Body.Close()
+
+		req, err := http.NewRequest("PATCH", url, strings.NewReader(`{"n":1}`))
+		if err != nil {
+			t.Fatalf("error creating patch request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.SetBasicAuth("bob", "")
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error patching %s: %v", path, err)
+		}
+		res.Body.Close()
+
+		res = send(t, "GET", url+"?envelope=true", nil)
+		var item Item
+		if err := json.NewDecoder(res.Body).Decode(&item); err != nil {
+			t.Fatalf("error decoding %s: %v", path, err)
+		}
+		res.Body.Close()
+		if res.Header.Get("Last-Modified") == "" {
+			t.Errorf("GET %s: want Last-Modified header", path)
+		}
+		if want, got := path, item.ID; want != got {
+			t.Errorf("want id %s, got %s", want, got)
+		}
+		if want, got := `{"n":1}`, string(item.Data); want != got {
+			t.Errorf("GET %s: want data %s, got %s", path, want, got)
+		}
+		if want, got := "ann@example.com", item.Author; want != got {
+			t.Errorf("GET %s: want author %q, got %q", path, want, got)
+		}
+		if want, got := "bob", item.Editor; want != got {
+			t.Errorf("GET %s: want editor %q, got %q", path, want, got)
+		}
+		created, err := time.Parse(time.RFC3339Nano, item.Created)
+		if err != nil {
+			t.Errorf("GET %s: invalid creation time: %v", path, err)
+		}
+		modified, err := time.Parse(time.RFC3339Nano, item.Modified)
+		if err != nil {
+			t.Errorf("GET %s: invalid modification time: %v", path, err)
+		}
+		if modified.Before(created) {
+			t.Errorf("GET %s: modified %s before created %s",
+				path, item.Modified, item.Created)
+		}
+	}
+
+	// Listed trials carry their metadata too.
+	res := send(t, "GET", study+"/trials", nil)
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if len(items) != 1 || items[0].Created == "" || items[0].Editor != "bob" {
+		t.Errorf("want trial listed with metadata, got %+v", items)
+	}
+
+	if want, got := http.StatusBadRequest,
+		status(t, "GET", study+"?envelope=maybe"); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,409 @@
+package xhub
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions below implement the request handling shared by our study,
+// trial, and file controllers.  Each resource is stored as a record in the
+// studies bucket, keyed by its id.
+
+// A createFunc is called within the transaction creating the resource id,
+// so that controllers can store related items along with it.
+type createFunc func(tx Tx, id string) error
+
+// postResource handles POST requests for the collection at parent, storing
+// the resource of type typ sent.
+func postResource(w http.ResponseWriter, r *http.Request, store Store,
+	typ, parent string, create createFunc) {
+
+	var rsc Resource
+	err := json.NewDecoder(r.Body).Decode(&rsc)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkResource(&rsc, typ, parent); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	var rec *record
+	err = store.Update(func(tx Tx) error {
+		old, err := getRecord(tx, rsc.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, rsc.ID, old); err != nil {
+			return err
+		}
+		if old == nil && create != nil {
+			if err := create(tx, rsc.ID); err != nil {
+				return err
+			}
+		}
+		rec, err = putRecord(tx, rsc.ID, old, rsc.Data, author(r))
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", rec.ETag())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// listResources handles GET requests for the collection at parent,
+// returning a list of its resources, each of type typ.  The resources are
+// filtered, and the ids of each resource's children included, as requested
+// (see whereParam and depthParam), and the list is paginated as requested
+// (see pageParam).  Clients accepting newline-delimited json receive a
+// stream of resources instead (see streamResources).
+func listResources(w http.ResponseWriter, r *http.Request, host string,
+	store Store, typ, parent string) {
+
+	depth, err := depthParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := pageParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, err := whereParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if accepts(r, ndjsonType) {
+		streamResources(w, r, host, store, typ, parent, depth, p, where)
+		return
+	}
+
+	resources := []*Resource{}
+	next := "" // id of the last resource on the page, if more follow
+
+	err = store.View(func(tx Tx) error {
+		listings, more, err := p.list(tx, parent, where)
+		if err != nil {
+			return err
+		}
+		if more {
+			next = listings[len(listings)-1].id
+		}
+
+		// Append each resource on the page to the list of resources.
+		for _, l := range listings {
+			rsc := newResource(host, typ, l.id, l.rec)
+			rsc.Children, err = childIDs(tx, rsc.ID, depth)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, rsc)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+
+	writePage(w, r, host, resources, next)
+}
+
+// writePage responds to r with a page of resources (see writeTagged),
+// reduced to the fields requested (see fieldsParam).  If more resources
+// follow the page, next is the id of the last resource on the page, and
+// the response links to the following page.
+func writePage(w http.ResponseWriter, r *http.Request, host string,
+	resources []*Resource, next string) {
+
+	fields, err := fieldsParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v, err := fields.apply(resources)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if next != "" {
+		setNext(w, r, host, next)
+	}
+	writeTagged(w, r, v)
+}
+
+// newResource returns the resource of type typ identified by id, as
+// described by its stored record.
+func newResource(host, typ, id string, rec *record) *Resource {
+	return &Resource{
+		Version:  "1",
+		Type:     typ,
+		ID:       id,
+		URL:      "http://" + host + id,
+		Data:     rec.Data,
+		Created:  rec.Created,
+		Modified: rec.Modified,
+		Author:   rec.Author,
+		Editor:   rec.Editor,
+		ETag:     rec.ETag(),
+	}
+}
+
+// writeTagged responds to r with the json encoding of v, typically a list
+// of resources.  The response is tagged with a weak entity tag derived
+// from its contents, so that clients can avoid retrieving an unchanged
+// response again.
+func writeTagged(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	etag := fmt.Sprintf(`W/"%x"`, sha1.Sum(body))
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// getResource handles GET requests for the resource id of type typ,
+// returning its raw json data payload.  If the request's envelope
+// parameter is true, the payload is returned wrapped in a json-encoded
+// Resource, along with the resource's metadata.  Requesting the ids of
+// the resource's children (see depthParam) or particular fields of the
+// resource (see fieldsParam) implies an envelope.
+func getResource(w http.ResponseWriter, r *http.Request, host string,
+	store Store, config *Config, typ, id string) {
+
+	envelope, err := boolParam(r, "envelope")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	depth, err := depthParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := fieldsParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rec *record
+	var children []string
+	err = store.View(func(tx Tx) error {
+		rec, err = getRecord(tx, id)
+		if err != nil || rec == nil {
+			return err
+		}
+		children, err = childIDs(tx, id, depth)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rec == nil {
+		config.notFound(w, r, id)
+		return
+	}
+
+	var rsc *Resource
+	if envelope || depth > 0 || fields != nil {
+		rsc = newResource(host, typ, id, rec)
+		rsc.Children = children
+	}
+	writeRecord(w, r, rec, rsc, fields)
+}
+
+// writeRecord responds to r with the revision of a resource described by
+// rec: either its raw json data payload or, if rsc is not nil, the
+// resource rsc wrapping the payload, reduced to the given fields.
+func writeRecord(w http.ResponseWriter, r *http.Request, rec *record,
+	rsc *Resource, fields projection) {
+
+	w.Header().Set("ETag", rec.ETag())
+	if t, err := time.Parse(time.RFC3339Nano, rec.Modified); err == nil {
+		w.Header().Set("Last-Modified", t.Format(http.TimeFormat))
+	}
+	if notModified(r, rec.ETag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if rsc == nil {
+		writeDocument(w, http.StatusOK, rec.Data)
+		return
+	}
+	v, err := fields.apply(rsc)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// accepts reports whether r explicitly accepts a response of the given
+// media type, as listed in its Accept header.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		typ, _, err := mime.ParseMediaType(accept)
+		if err == nil && typ == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// boolParam returns the value of the boolean query parameter name of r,
+// which is false if the parameter is absent.
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter %q: expecting "+
+			"true or false", name, v)
+	}
+	return b, nil
+}
+
+// putResource handles PUT requests for the resource id, replacing its json
+// data payload with the json document sent.  The resource is created if it
+// doesn't exist yet.
+func putResource(w http.ResponseWriter, r *http.Request, store Store,
+	id string, create createFunc) {
+
+	data, err := readDocument(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	var rec *record
+	err = store.Update(func(tx Tx) error {
+		old, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, id, old); err != nil {
+			return err
+		}
+		if old == nil {
+			status = http.StatusCreated
+			if create != nil {
+				if err := create(tx, id); err != nil {
+					return err
+				}
+			}
+		}
+		rec, err = putRecord(tx, id, old, data, author(r))
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", rec.ETag())
+	writeDocument(w, status, rec.Data)
+}
+
+// patchResource handles PATCH requests for the resource id, applying the
+// patch document sent (either a json merge patch or a json patch) to its
+// json data payload.
+func patchResource(w http.ResponseWriter, r *http.Request, store Store,
+	id string) {
+
+	w.Header().Set("Accept-Patch", acceptPatch)
+
+	var rec *record
+	err := store.Update(func(tx Tx) error {
+		old, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, id, old); err != nil {
+			return err
+		}
+		if old == nil {
+			return errorf(http.StatusNotFound, "%s not found", id)
+		}
+		data, status, err := patchDocument(r, old.Data)
+		if err != nil {
+			return &statusError{status, err.Error()}
+		}
+		rec, err = putRecord(tx, id, old, data, author(r))
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", rec.ETag())
+	writeDocument(w, http.StatusOK, rec.Data)
+}
+
+// deleteResources handles DELETE requests for the resource id, moving it
+// to the trash along with all resources rooted at the given ids (which
+// should include id itself).  If the request carries an If-Match header,
+// it's checked against the resource id.  All resources are moved in a
+// single transaction, so either all of them are deleted or none are.  The
+// response summarizes the number of trials and files deleted, unless the
+// resource doesn't exist (see Config.notFound).
+func deleteResources(w http.ResponseWriter, r *http.Request, store Store,
+	config *Config, id string, roots []string) {
+
+	var summary *Summary
+	err := store.Update(func(tx Tx) error {
+		rec, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkPreconditions(r, id, rec); err != nil {
+			return err
+		}
+		if rec == nil {
+			return nil
+		}
+		summary, err = moveToTrash(tx, id, roots, author(r))
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	if summary == nil {
+		config.notFound(w, r, id)
+		return
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
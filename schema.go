@@ -0,0 +1,708 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Each study can carry a JSON Schema for the data payloads of its trials
+// and another for those of its files, kept in the store's schemas bucket
+// under the study id followed by the resource type (e.g.,
+// `/studies/STUDY_A/trial`).  Trials and files are checked against the
+// schema of their study whenever they're written (see putRecord).
+//
+// Schemas are interpreted according to a subset of JSON Schema (draft
+// 2020-12): the type, enum, and const keywords; properties, required,
+// and additionalProperties for objects; items, minItems, maxItems, and
+// uniqueItems for arrays; minLength, maxLength, and pattern for strings;
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, and multipleOf for
+// numbers; and the allOf, anyOf, oneOf, and not combinators.  Annotations
+// such as title, description, and format are ignored, while schemas using
+// other keywords (e.g., $ref) are rejected.
+
+// schemaTypes lists the json types a schema can require.
+var schemaTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// unsupportedKeywords lists the JSON Schema keywords affecting validation
+// that we don't implement.
+var unsupportedKeywords = map[string]bool{
+	"$ref":                  true,
+	"$dynamicRef":           true,
+	"patternProperties":     true,
+	"propertyNames":         true,
+	"minProperties":         true,
+	"maxProperties":         true,
+	"dependencies":          true,
+	"dependentRequired":     true,
+	"dependentSchemas":      true,
+	"prefixItems":           true,
+	"contains":              true,
+	"minContains":           true,
+	"maxContains":           true,
+	"if":                    true,
+	"then":                  true,
+	"else":                  true,
+	"unevaluatedItems":      true,
+	"unevaluatedProperties": true,
+}
+
+// NewSchemaController initializes a new instance of our schema controller.
+func NewSchemaController(host string, store Store,
+	config *Config) *SchemaController {
+
+	return &SchemaController{host, store, config}
+}
+
+// A SchemaController handles requests for the schemas of studies.
+type SchemaController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// dataSchemaKey returns the key of the schema for resources of type typ
+// ("trial" or "file") in the study id.
+func dataSchemaKey(id, typ string) []byte {
+	return []byte(id + "/" + typ)
+}
+
+// getSchema returns the decoded schema for resources of type typ in the
+// study id, or nil if the study has none.
+func getSchema(tx Tx, id, typ string) (interface{}, error) {
+	v, err := tx.Get(schemaBucket, dataSchemaKey(id, typ))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return decodeJSON(v)
+}
+
+// checkSchema ensures that the decoded json document s, found at the json
+// pointer ptr within a schema, is a schema we can interpret.
+func checkSchema(s interface{}, ptr string) error {
+	if _, ok := s.(bool); ok {
+		return nil
+	}
+	obj, ok := s.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object or a boolean", ptr)
+	}
+	for _, name := range sortedKeys(obj) {
+		v := obj[name]
+		at := formatPointer(ptr, name)
+		if unsupportedKeywords[name] {
+			return fmt.Errorf("%s: unsupported keyword", at)
+		}
+		switch name {
+		case "type":
+			types, ok := v.([]interface{})
+			if !ok {
+				types = []interface{}{v}
+			}
+			for _, t := range types {
+				if s, ok := t.(string); !ok || !schemaTypes[s] {
+					return fmt.Errorf("%s: invalid type %v", at, t)
+				}
+			}
+		case "enum":
+			if _, ok := v.([]interface{}); !ok {
+				return fmt.Errorf("%s: expecting an array", at)
+			}
+		case "required":
+			names, ok := v.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: expecting an array of names", at)
+			}
+			for _, n := range names {
+				if _, ok := n.(string); !ok {
+					return fmt.Errorf("%s: expecting an array of names", at)
+				}
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: expecting an object", at)
+			}
+			for _, prop := range sortedKeys(props) {
+				err := checkSchema(props[prop], formatPointer(at, prop))
+				if err != nil {
+					return err
+				}
+			}
+		case "additionalProperties", "items", "not":
+			if err := checkSchema(v, at); err != nil {
+				return err
+			}
+		case "allOf", "anyOf", "oneOf":
+			subs, ok := v.([]interface{})
+			if !ok || len(subs) == 0 {
+				return fmt.Errorf("%s: expecting an array of schemas", at)
+			}
+			for i, sub := range subs {
+				err := checkSchema(sub, formatPointer(at, strconv.Itoa(i)))
+				if err != nil {
+					return err
+				}
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum",
+			"multipleOf":
+			f, ok := number(v)
+			if !ok || (name == "multipleOf" && f <= 0) {
+				return fmt.Errorf("%s: expecting a number", at)
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			if _, ok := count(v); !ok {
+				return fmt.Errorf("%s: expecting a non-negative integer", at)
+			}
+		case "uniqueItems":
+			if _, ok := v.(bool); !ok {
+				return fmt.Errorf("%s: expecting a boolean", at)
+			}
+		case "pattern":
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s: expecting a regular expression", at)
+			}
+			if _, err := regexp.Compile(s); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+	}
+	return nil
+}
+
+// number returns the value of the decoded json number v.
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// isMultiple reports whether the json number x is a multiple of m.  The
+// numbers are compared exactly, as written, since decimal fractions like
+// 0.1 have no exact floating point representation.
+func isMultiple(x, m json.Number) bool {
+	a, ok := new(big.Rat).SetString(string(x))
+	b, ok2 := new(big.Rat).SetString(string(m))
+	if !ok || !ok2 || b.Sign() == 0 {
+		return false
+	}
+	return a.Quo(a, b).IsInt()
+}
+
+// count returns the value of the decoded json number v if it's a
+// non-negative integer.
+func count(v interface{}) (int, bool) {
+	f, ok := number(v)
+	if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// jsonType returns the name of the json type of the decoded value v.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	}
+	return "string"
+}
+
+// hasType reports whether the decoded json value v is of the schema type
+// typ.  Integers are numbers without a fractional part.
+func hasType(v interface{}, typ string) bool {
+	if typ == "integer" {
+		f, ok := number(v)
+		return ok && f == math.Trunc(f)
+	}
+	return jsonType(v) == typ
+}
+
+// match appends the violations of the schema s by the decoded json value
+// v, found at path (e.g., `data.subject.age`), to vs.  Values of the wrong
+// type aren't checked any further.
+func match(s, v interface{}, path string, vs []*Violation) []*Violation {
+	if b, ok := s.(bool); ok {
+		if !b {
+			vs = append(vs, &Violation{path, "no value is allowed"})
+		}
+		return vs
+	}
+	schema := s.(map[string]interface{})
+
+	if t, ok := schema["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		var names []string
+		matched := false
+		for _, typ := range types {
+			names = append(names, typ.(string))
+			matched = matched || hasType(v, typ.(string))
+		}
+		if !matched {
+			return append(vs, &Violation{path, fmt.Sprintf("expecting %s, "+
+				"got %s", strings.Join(names, " or "), jsonType(v))})
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			data, _ := json.Marshal(enum)
+			vs = append(vs, &Violation{path, fmt.Sprintf("expecting one "+
+				"of %s", data)})
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		data, _ := json.Marshal(c)
+		vs = append(vs, &Violation{path, fmt.Sprintf("expecting %s", data)})
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := x[name.(string)]; !ok {
+					vs = append(vs, &Violation{path + "." + name.(string),
+						"required value is missing"})
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		additional, hasAdditional := schema["additionalProperties"]
+		for _, name := range sortedKeys(x) {
+			at := path + "." + name
+			if sub, ok := props[name]; ok {
+				vs = match(sub, x[name], at, vs)
+			} else if b, ok := additional.(bool); ok && !b {
+				vs = append(vs, &Violation{at, "unexpected value (not " +
+					"among the schema's properties)"})
+			} else if hasAdditional {
+				vs = match(additional, x[name], at, vs)
+			}
+		}
+	case []interface{}:
+		if n, ok := count(schema["minItems"]); ok && len(x) < n {
+			vs = append(vs, &Violation{path, fmt.Sprintf("expecting at "+
+				"least %d items, got %d", n, len(x))})
+		}
+		if n, ok := count(schema["maxItems"]); ok && len(x) > n {
+			vs = append(vs, &Violation{path, fmt.Sprintf("expecting at "+
+				"most %d items, got %d", n, len(x))})
+		}
+		if unique, _ := schema["uniqueItems"].(bool); unique {
+		dups:
+			for i := range x {
+				for j := 0; j < i; j++ {
+					if jsonEqual(x[i], x[j]) {
+						vs = append(vs, &Violation{path, fmt.Sprintf(
+							"items %d and %d are equal", j, i)})
+						break dups
+					}
+				}
+			}
+		}
+		if items, ok := schema["items"]; ok {
+			for i, elem := range x {
+				vs = match(items, elem, path+"."+strconv.Itoa(i), vs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(x)
+		if min, ok := count(schema["minLength"]); ok && n < min {
+			vs = append(vs, &Violation{path, fmt.Sprintf("expecting at "+
+				"least %d characters, got %d", min, n)})
+		}
+		if max, ok := count(schema["maxLength"]); ok && n > max {
+			vs = append(vs, &Violation{path, fmt.Sprintf("expecting at "+
+				"most %d characters, got %d", max, n)})
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if !regexp.MustCompile(pattern).MatchString(x) {
+				vs = append(vs, &Violation{path, fmt.Sprintf("expecting "+
+					"a string matching %q", pattern)})
+			}
+		}
+	case json.Number:
+		f, _ := number(x)
+		for _, bound := range []struct {
+			keyword string
+			fails   func(limit float64) bool
+			detail  string
+		}{
+			{"minimum", func(l float64) bool { return f < l }, "at least"},
+			{"maximum", func(l float64) bool { return f > l }, "at most"},
+			{"exclusiveMinimum", func(l float64) bool { return f <= l },
+				"more than"},
+			{"exclusiveMaximum", func(l float64) bool { return f >= l },
+				"less than"},
+		} {
+			if limit, ok := number(schema[bound.keyword]); ok &&
+				bound.fails(limit) {
+				vs = append(vs, &Violation{path, fmt.Sprintf("expecting "+
+					"%s %v, got %v", bound.detail, limit, x)})
+			}
+		}
+		if m, ok := schema["multipleOf"].(json.Number); ok {
+			if !isMultiple(x, m) {
+				vs = append(vs, &Violation{path, fmt.Sprintf("expecting a "+
+					"multiple of %v, got %v", m, x)})
+			}
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			vs = match(sub, v, path, vs)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		if matches(anyOf, v, path) == 0 {
+			vs = append(vs, &Violation{path, "doesn't match any of the " +
+				"anyOf schemas"})
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if n := matches(oneOf, v, path); n != 1 {
+			vs = append(vs, &Violation{path, fmt.Sprintf("matches %d of "+
+				"the oneOf schemas (expecting exactly 1)", n)})
+		}
+	}
+	if not, ok := schema["not"]; ok && len(match(not, v, path, nil)) == 0 {
+		vs = append(vs, &Violation{path, "matches the schema under not"})
+	}
+	return vs
+}
+
+// matches returns the number of the schemas that the decoded json value v,
+// found at path, matches.
+func matches(schemas []interface{}, v interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		if len(match(sub, v, path, nil)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// A dataError reports the violations of a study's schema (or of its trial
+// template) by the data payload of one of its trials or files.
+type dataError struct {
+	id         string
+	against    string // e.g., "the study's trial schema"
+	violations []*Violation
+}
+
+func (e *dataError) Error() string {
+	var list []string
+	for _, v := range e.violations {
+		list = append(list, v.Path+": "+v.Detail)
+	}
+	return fmt.Sprintf("data payload of %s doesn't match %s (%s)", e.id,
+		e.against, strings.Join(list, "; "))
+}
+
+// checkData checks the json-encoded data payload of the resource id
+// against the schema of its study, if it's a trial or file and the study
+// has one, returning a dataError listing any violations.
+func checkData(tx Tx, id string, data []byte) error {
+	typ := resourceType(id)
+	if typ != "trial" && typ != "file" {
+		return nil
+	}
+	study := "/studies/" + strings.Split(id, "/")[2]
+	schema, err := getSchema(tx, study, typ)
+	if err != nil || schema == nil {
+		return err
+	}
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return err
+	}
+	if vs := match(schema, doc, "data", nil); len(vs) > 0 {
+		return &dataError{id, "the study's " + typ + " schema", vs}
+	}
+	return nil
+}
+
+// schemaReport checks the data payloads of the resources of type typ in
+// the study id against schema, reporting those that fail.
+func schemaReport(tx Tx, id, typ string,
+	schema interface{}) (*SchemaReport, error) {
+
+	report := &SchemaReport{Study: id, Type: typ, Failed: []*Validation{}}
+	collections := []string{id + "/trials"}
+	if typ == "file" {
+		collections = []string{id + "/files"}
+		trials, err := tx.Children(studiesBucket, []byte(id+"/trials"))
+		if err != nil {
+			return nil, err
+		}
+		for _, trial := range trials {
+			collections = append(collections,
+				childCollections(string(trial.Key))...)
+		}
+	}
+	for _, collection := range collections {
+		items, err := tx.Children(studiesBucket, []byte(collection))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			rec, err := decodeRecord(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := decodeJSON(rec.Data)
+			if err != nil {
+				return nil, fmt.Errorf("stored document is invalid: %v", err)
+			}
+			report.Checked++
+			if vs := match(schema, doc, "data", nil); len(vs) > 0 {
+				report.Failed = append(report.Failed, &Validation{
+					ID:         string(item.Key),
+					Violations: vs,
+				})
+			}
+		}
+	}
+	return report, nil
+}
+
+// schemaParams returns the id of the study and the resource type named by
+// the parameters of requests for `/studies/:study/schemas/:resource`, or
+// responds with 404 Not Found if there's no such type of resource.
+func (c *SchemaController) schemaParams(w http.ResponseWriter,
+	r *http.Request, p httprouter.Params) (string, string, bool) {
+
+	id, typ := "/studies/"+p.ByName("study"), p.ByName("resource")
+	if typ != "trial" && typ != "file" {
+		c.config.notFound(w, r, id+"/schemas/"+typ)
+		return "", "", false
+	}
+	return id, typ, true
+}
+
+// Get handles GET requests for `/studies/:study/schemas/:resource`,
+// returning the study's schema for the data payloads of its trials or
+// files (as the resource parameter is "trial" or "file").
+func (c *SchemaController) Get(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id, typ, ok := c.schemaParams(w, r, p)
+	if !ok {
+		return
+	}
+	data, err := c.store.Get(schemaBucket, dataSchemaKey(id, typ))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if data == nil {
+		c.config.notFound(w, r, id+"/schemas/"+typ)
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// Put handles PUT requests for `/studies/:study/schemas/:resource`,
+// attaching the schema sent to the study, replacing any attached before.
+// The schema applies to trials and files written from then on, while
+// existing ones are left as they are: the response reports those that
+// fail the new schema (see Report).
+func (c *SchemaController) Put(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id, typ, ok := c.schemaParams(w, r, p)
+	if !ok {
+		return
+	}
+	data, err := readDocument(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	schema, _ := decodeJSON(data)
+	if err := checkSchema(schema, "#"); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity,
+			"invalid schema: "+err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	var report *SchemaReport
+	err = c.store.Update(func(tx Tx) error {
+		rec, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errorf(http.StatusNotFound, "%s not found", id)
+		}
+		old, err := tx.Get(schemaBucket, dataSchemaKey(id, typ))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			status = http.StatusCreated
+		}
+		if err := tx.Put(schemaBucket, dataSchemaKey(id, typ), data); err != nil {
+			return err
+		}
+		report, err = schemaReport(tx, id, typ, schema)
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	c.writeReport(w, r, status, report)
+}
+
+// Delete handles DELETE requests for `/studies/:study/schemas/:resource`,
+// detaching the schema from the study.
+func (c *SchemaController) Delete(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id, typ, ok := c.schemaParams(w, r, p)
+	if !ok {
+		return
+	}
+	err := c.store.Update(func(tx Tx) error {
+		old, err := tx.Get(schemaBucket, dataSchemaKey(id, typ))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return errorf(http.StatusNotFound, "%s/schemas/%s not found",
+				id, typ)
+		}
+		return tx.Delete(schemaBucket, dataSchemaKey(id, typ))
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Validate handles POST requests for
+// `/studies/:study/schemas/:resource/validate`, checking the data payload
+// sent against the study's schema without storing anything.  The response
+// lists any violations.
+func (c *SchemaController) Validate(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id, typ, ok := c.schemaParams(w, r, p)
+	if !ok {
+		return
+	}
+	data, err := readDocument(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var schema interface{}
+	err = c.store.View(func(tx Tx) (err error) {
+		schema, err = getSchema(tx, id, typ)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if schema == nil {
+		c.config.notFound(w, r, id+"/schemas/"+typ)
+		return
+	}
+	doc, _ := decodeJSON(data)
+	v := &Validation{Valid: true, Violations: []*Violation{}}
+	if vs := match(schema, doc, "data", nil); len(vs) > 0 {
+		v.Valid, v.Violations = false, vs
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// Report handles GET requests for
+// `/studies/:study/schemas/:resource/report`, checking the existing
+// trials or files of the study against its schema and listing those that
+// fail, along with their violations.
+func (c *SchemaController) Report(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id, typ, ok := c.schemaParams(w, r, p)
+	if !ok {
+		return
+	}
+	var report *SchemaReport
+	err := c.store.View(func(tx Tx) error {
+		schema, err := getSchema(tx, id, typ)
+		if err != nil || schema == nil {
+			return err
+		}
+		report, err = schemaReport(tx, id, typ, schema)
+		return err
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	if report == nil {
+		c.config.notFound(w, r, id+"/schemas/"+typ)
+		return
+	}
+	c.writeReport(w, r, http.StatusOK, report)
+}
+
+// writeReport responds to r with the schema report.
+func (c *SchemaController) writeReport(w http.ResponseWriter,
+	r *http.Request, status int, report *SchemaReport) {
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, status, data)
+}
@@ -0,0 +1,216 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A Violation models a value failing to match a schema.
+type Violation struct {
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+}
+
+// A SchemaReport models the resources of a study failing its schema.
+type SchemaReport struct {
+	Study   string `json:"study"`
+	Type    string `json:"resource"`
+	Checked int    `json:"checked"`
+	Failed  []struct {
+		ID         string      `json:"id"`
+		Violations []Violation `json:"violations"`
+	} `json:"failed"`
+}
+
+// Ensure the data payloads of trials and files are checked against the
+// schemas of their studies.
+func TestSchema(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for path, doc := range map[string]string{
+		"/studies/a":           `{"name":"A"}`,
+		"/studies/a/trials/t1": `{"subject":"rat_3","weight":310}`,
+		"/studies/a/trials/t2": `{"subjcet":"rat_4"}`,
+		"/files/a/t1/f1":       `{"format":"csv"}`,
+		"/files/a/t2/f2":       `{"format":"avi"}`,
+		"/studies/a/files/f3":  `{"format":"pdf"}`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	// Attaching a schema reports the existing resources failing it.
+	trialSchema := `{
+		"type": "object",
+		"required": ["subject"],
+		"properties": {
+			"subject": {"type": "string", "pattern": "^rat_[0-9]+$"},
+			"weight": {"type": "integer", "minimum": 0},
+			"dose": {"type": "number", "multipleOf": 0.1},
+			"tags": {"type": "array", "items": {"enum": ["x", "y"]}}
+		},
+		"additionalProperties": false
+	}`
+	url := srv.addr + "/studies/a/schemas/trial"
+	var report SchemaReport
+	if want, got := http.StatusCreated, putSchema(t, url, trialSchema,
+		&report); want != got {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+	if report.Checked != 2 || len(report.Failed) != 1 ||
+		report.Failed[0].ID != "/studies/a/trials/t2" {
+		t.Errorf("want t2 failing, got %+v", report)
+	}
+	want := []Violation{
+		{"data.subject", "required value is missing"},
+		{"data.subjcet", "unexpected value (not among the schema's " +
+			"properties)"},
+	}
+	if got := report.Failed[0].Violations; !reflect.DeepEqual(want, got) {
+		t.Errorf("want violations %+v, got %+v", want, got)
+	}
+
+	fileSchema := `{"properties":{"format":{"enum":["csv","pdf"]}}}`
+	report = SchemaReport{}
+	putSchema(t, srv.addr+"/studies/a/schemas/file", fileSchema, &report)
+	if report.Checked != 3 || len(report.Failed) != 1 ||
+		report.Failed[0].ID != "/files/a/t2/f2" {
+		t.Errorf("want f2 failing, got %+v", report)
+	}
+
+	// Writes are checked against the schema.
+	trial := `{"version":"0.1","resource":"trial",` +
+		`"id":"/studies/a/trials/t3","data":{"subject":"rat_5",` +
+		`"weight":1.5,"tags":["x","z"]}}`
+	res := send(t, "POST", srv.addr+"/studies/a/trials",
+		strings.NewReader(trial))
+	var problem struct {
+		Status     int         `json:"status"`
+		Violations []Violation `json:"violations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+	res.Body.Close()
+	if want, got := http.StatusUnprocessableEntity, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	want = []Violation{
+		{"data.tags.1", `expecting one of ["x","y"]`},
+		{"data.weight", "expecting integer, got number"},
+	}
+	if got := problem.Violations; !reflect.DeepEqual(want, got) {
+		t.Errorf("want violations %+v, got %+v", want, got)
+	}
+	for _, tt := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"PUT", "/studies/a/trials/t1", `{"subject":"mouse_1"}`,
+			http.StatusUnprocessableEntity},
+		{"PUT", "/studies/a/trials/t1", `{"subject":"rat_1"}`, http.StatusOK},
+		{"PUT", "/studies/a/trials/t1", `{"subject":"rat_1","dose":0.7}`,
+			http.StatusOK},
+		{"PUT", "/studies/a/trials/t1", `{"subject":"rat_1","dose":0.3}`,
+			http.StatusOK},
+		{"PUT", "/studies/a/trials/t1", `{"subject":"rat_1","dose":0.35}`,
+			http.StatusUnprocessableEntity},
+		{"PUT", "/studies/a/files/f4", `{"format":"avi"}`,
+			http.StatusUnprocessableEntity},
+		{"PUT", "/files/a/t1/f4", `{"format":"csv"}`, http.StatusCreated},
+		// other studies and the study itself aren't checked
+		{"PUT", "/studies/b/trials/t1", `{"subject":1}`, http.StatusCreated},
+		{"PUT", "/studies/a", `{"name":1}`, http.StatusOK},
+	} {
+		res := send(t, tt.method, srv.addr+tt.path,
+			strings.NewReader(tt.body))
+		res.Body.Close()
+		if got := res.StatusCode; tt.want != got {
+			t.Errorf("%s %s %s: want %d, got %d", tt.method, tt.path,
+				tt.body, tt.want, got)
+		}
+	}
+
+	// Payloads can be checked without being stored.
+	var v struct {
+		Valid      bool        `json:"valid"`
+		Violations []Violation `json:"violations"`
+	}
+	res = send(t, "POST", url+"/validate",
+		strings.NewReader(`{"subject":"rat_1","weight":-1}`))
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		t.Fatalf("error decoding validation: %v", err)
+	}
+	res.Body.Close()
+	if v.Valid || len(v.Violations) != 1 ||
+		v.Violations[0].Path != "data.weight" {
+		t.Errorf("want weight violation, got %+v", v)
+	}
+
+	// Schemas go to the trash with their study, and come back with it.
+	status(t, "DELETE", srv.addr+"/studies/a")
+	if want, got := http.StatusNotFound, status(t, "GET", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	status(t, "POST", srv.addr+"/trash/studies/a/restore")
+	res = send(t, "GET", url+"/report", nil)
+	report = SchemaReport{}
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	res.Body.Close()
+	if report.Checked != 2 || len(report.Failed) != 1 {
+		t.Errorf("want report on restored study, got %+v", report)
+	}
+
+	if want, got := http.StatusNoContent,
+		status(t, "DELETE", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	res = send(t, "PUT", srv.addr+"/studies/a/trials/t1",
+		strings.NewReader(`{"subject":"mouse_1"}`))
+	res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Errorf("want %d after detaching schema, got %d", want, got)
+	}
+
+	for _, tt := range []struct {
+		path, schema string
+		want         int
+	}{
+		{"/studies/a/schemas/trial", `{"type":"int"}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/schemas/trial", `{"$ref":"#/defs/x"}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/schemas/trial", `{"pattern":"("}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/schemas/trial", `{"minItems":-1}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/schemas/trial", `{"type":`, http.StatusBadRequest},
+		{"/studies/a/schemas/study", `{}`, http.StatusNotFound},
+		{"/studies/c/schemas/trial", `{}`, http.StatusNotFound},
+	} {
+		got := putSchema(t, srv.addr+tt.path, tt.schema, nil)
+		if tt.want != got {
+			t.Errorf("PUT %s %s: want %d, got %d", tt.path, tt.schema,
+				tt.want, got)
+		}
+	}
+}
+
+// putSchema attaches the schema at url, decoding the report returned into
+// report (if given) and returning the response status.
+func putSchema(t *testing.T, url, schema string, report *SchemaReport) int {
+	res := send(t, "PUT", url, strings.NewReader(schema))
+	defer res.Body.Close()
+	if report != nil {
+		if err := json.NewDecoder(res.Body).Decode(report); err != nil {
+			t.Fatalf("error decoding report: %v", err)
+		}
+	}
+	return res.StatusCode
+}
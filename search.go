@@ -0,0 +1,358 @@
+package xhub
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The search index is an inverted index of the words in the text of each
+// resource (see searchText), kept in the store's search bucket.  Each word
+// (or term) is a run of letters and digits, folded to lower case, and the
+// entries (or postings) for a term are the children of the term's key:
+// each entry is keyed by the term followed by the escaped id of a resource
+// in which the term occurs, and holds the number of its occurrences.  Like
+// other indexes, the search index is updated along with the records of
+// resources.
+
+// maxTermLen is the length, in runes, of the longest term indexed.  Longer
+// runs of letters and digits (e.g., encoded binary data) aren't indexed.
+const maxTermLen = 64
+
+// snippetLen is the approximate length, in runes, of snippets excerpted
+// from the text of search hits.
+const snippetLen = 120
+
+// NewSearchController initializes a new instance of our search controller.
+func NewSearchController(host string, store Store,
+	config *Config) *SearchController {
+
+	return &SearchController{host, store, config}
+}
+
+// A SearchController handles full-text search requests.
+type SearchController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// A textField is a string value within the data payload of a resource.
+type textField struct {
+	path string // path of the value, e.g. `data.desc`
+	text string
+}
+
+// searchText returns the text of the resource id described by rec: the
+// name and description of a study, or all string values within the data
+// payload of a trial or file, in path order.
+func searchText(id string, rec *record) ([]textField, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	doc, err := decodeJSON(rec.Data)
+	if err != nil {
+		return nil, fmt.Errorf("stored document is invalid: %v", err)
+	}
+	var fields []textField
+	if resourceType(id) == "study" {
+		obj, _ := doc.(map[string]interface{})
+		for _, name := range []string{"name", "desc"} {
+			if s, ok := obj[name].(string); ok {
+				fields = append(fields, textField{"data." + name, s})
+			}
+		}
+		return fields, nil
+	}
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch x := v.(type) {
+		case string:
+			fields = append(fields, textField{path, x})
+		case map[string]interface{}:
+			for _, name := range sortedKeys(x) {
+				walk(path+"."+name, x[name])
+			}
+		case []interface{}:
+			for i, elem := range x {
+				walk(path+"."+strconv.Itoa(i), elem)
+			}
+		}
+	}
+	walk("data", doc)
+	return fields, nil
+}
+
+// A term is a word occurring in text, located by its byte offsets.
+type term struct {
+	word       string
+	start, end int
+}
+
+// terms returns the terms occurring in text, in order.
+func terms(text string) []term {
+	var ts []term
+	start := -1
+	for i, r := range text + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			word := strings.ToLower(text[start:i])
+			if utf8.RuneCountInString(word) <= maxTermLen {
+				ts = append(ts, term{word, start, i})
+			}
+			start = -1
+		}
+	}
+	return ts
+}
+
+// termCounts returns the number of occurrences of each term in the text
+// of the resource id described by rec.
+func termCounts(id string, rec *record) (map[string]int, error) {
+	fields, err := searchText(id, rec)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, f := range fields {
+		for _, t := range terms(f.text) {
+			counts[t.word]++
+		}
+	}
+	return counts, nil
+}
+
+// updateSearch replaces the search index entries of the resource id for
+// its old record with those for rec.  Either record is nil if the resource
+// is being created or deleted, respectively.
+func updateSearch(tx Tx, id string, old, rec *record) error {
+	suffix := "/" + url.PathEscape(id)
+	counts, err := termCounts(id, old)
+	if err != nil {
+		return err
+	}
+	for word := range counts {
+		key := []byte(word + suffix)
+		if err := tx.Delete(searchBucket, key); err != nil {
+			return err
+		}
+	}
+	if counts, err = termCounts(id, rec); err != nil {
+		return err
+	}
+	for word, n := range counts {
+		key, v := []byte(word+suffix), []byte(strconv.Itoa(n))
+		if err := tx.Put(searchBucket, key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A searchHit is a resource matching a search query, as it's ranked.
+type searchHit struct {
+	id      string
+	matched int     // number of query terms occurring in the resource
+	score   float64 // sum of the weights of the terms occurring
+}
+
+// search returns the resources whose text contains any of the words, best
+// matches first.  Hits are ranked by the number of words they contain,
+// then by the sum of the weights of the words contained, where a word
+// weighs more the more often it occurs in the hit and the fewer resources
+// it occurs in.
+func search(tx Tx, words []string) ([]*searchHit, error) {
+	hits := map[string]*searchHit{}
+	for _, word := range words {
+		items, err := tx.Children(searchBucket, []byte(word))
+		if err != nil {
+			return nil, err
+		}
+		idf := 1 / float64(len(items))
+		for _, item := range items {
+			key := string(item.Key)
+			id, err := url.PathUnescape(key[len(word)+1:])
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(string(item.Value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid search entry %q: %v", key,
+					err)
+			}
+			hit := hits[id]
+			if hit == nil {
+				hit = &searchHit{id: id}
+				hits[id] = hit
+			}
+			hit.matched++
+			hit.score += (1 + math.Log(float64(n))) * idf
+		}
+	}
+
+	ranked := make([]*searchHit, 0, len(hits))
+	for _, hit := range hits {
+		ranked = append(ranked, hit)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		switch {
+		case a.matched != b.matched:
+			return a.matched > b.matched
+		case a.score != b.score:
+			return a.score > b.score
+		}
+		return a.id < b.id
+	})
+	return ranked, nil
+}
+
+// snippet returns the text field of the resource id best matching the
+// words (i.e., containing the most occurrences of them), along with an
+// excerpt of its text around the first occurrence.
+func snippet(id string, rec *record, words []string) (string, string, error) {
+	fields, err := searchText(id, rec)
+	if err != nil {
+		return "", "", err
+	}
+	wanted := map[string]bool{}
+	for _, w := range words {
+		wanted[w] = true
+	}
+	best, most := -1, 0
+	var first term
+	for i, f := range fields {
+		n := 0
+		var found term
+		for _, t := range terms(f.text) {
+			if wanted[t.word] {
+				if n == 0 {
+					found = t
+				}
+				n++
+			}
+		}
+		if n > most {
+			best, most, first = i, n, found
+		}
+	}
+	if best < 0 {
+		return "", "", nil
+	}
+	return fields[best].path, excerpt(fields[best].text, first), nil
+}
+
+// excerpt returns about snippetLen runes of text around the term t,
+// starting a little before it, with ellipses marking any text left out.
+func excerpt(text string, t term) string {
+	runes := []rune(text)
+	at := utf8.RuneCountInString(text[:t.start])
+	start := at - snippetLen/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLen
+	if end > len(runes) {
+		end = len(runes)
+	}
+	s := strings.TrimSpace(string(runes[start:end]))
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(runes) {
+		s += "…"
+	}
+	return s
+}
+
+// Search handles GET requests for `/search`, returning a list of the
+// resources whose text contains any of the words of the query given by the
+// request's q parameter, best matches first.  Each hit includes a snippet
+// of its best-matching text, along with the ids of the study and trial it
+// belongs to.  The limit parameter caps the number of hits listed.
+func (c *SearchController) Search(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+
+	q := r.URL.Query()
+	var words []string
+	seen := map[string]bool{}
+	for _, t := range terms(q.Get("q")) {
+		if !seen[t.word] {
+			words = append(words, t.word)
+			seen[t.word] = true
+		}
+	}
+	if len(words) == 0 {
+		writeError(w, r, http.StatusBadRequest,
+			"missing q parameter: expecting words to search for")
+		return
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest,
+				fmt.Sprintf("invalid limit parameter %q: expecting a "+
+					"positive integer", v))
+			return
+		}
+		limit = n
+	}
+
+	results := []*SearchResult{}
+	err := c.store.View(func(tx Tx) error {
+		hits, err := search(tx, words)
+		if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			if limit > 0 && len(results) == limit {
+				break
+			}
+			rec, err := getRecord(tx, hit.id)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				continue
+			}
+			typ := resourceType(hit.id)
+			result := &SearchResult{
+				Resource: newResource(c.host, typ, hit.id, rec),
+				Score:    hit.score,
+			}
+			result.Field, result.Snippet, err = snippet(hit.id, rec, words)
+			if err != nil {
+				return err
+			}
+			for id := parentID(hit.id); id != ""; id = parentID(id) {
+				switch resourceType(id) {
+				case "study":
+					result.Study = id
+				case "trial":
+					result.Trial = id
+				}
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	writeTagged(w, r, results)
+}
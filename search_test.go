@@ -0,0 +1,144 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A SearchResult models a resource matching a full-text search.
+type SearchResult struct {
+	Item
+	Score   float64 `json:"score"`
+	Field   string  `json:"field"`
+	Snippet string  `json:"snippet"`
+	Study   string  `json:"study"`
+	Trial   string  `json:"trial"`
+}
+
+// Ensure resources can be found by the words in their text, ranked by
+// relevance.
+func TestSearch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	long := strings.Repeat("Lorem ipsum dolor sit amet. ", 10)
+	for path, doc := range map[string]string{
+		"/studies/a": `{"name":"Jumping","desc":"Filmed with the ` +
+			`high-speed biplanar rig."}`,
+		"/studies/b": `{"name":"Walking","desc":"Treadmill gait",` +
+			`"rig":"biplanar"}`,
+		"/studies/a/trials/t1": `{"notes":["calibrated","rig drifted"],` +
+			`"subject":{"name":"Rat 3"}}`,
+		"/files/a/t1/f1": `{"comment":"` + long + `Biplanar rig ` +
+			`reset. ` + long + `"}`,
+		"/studies/b/files/f2": `{"kind":"video","size":3}`,
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	results := searchFor(t, srv.addr, "high-speed Biplanar rig")
+	var ids []string
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	// Only the name and description of studies are searched.
+	want := []string{"/studies/a", "/files/a/t1/f1", "/studies/a/trials/t1"}
+	if !reflect.DeepEqual(want, ids) {
+		t.Fatalf("want hits %v, got %v", want, ids)
+	}
+	if results[0].Score <= results[1].Score {
+		t.Errorf("want hits ranked by score, got %v then %v",
+			results[0].Score, results[1].Score)
+	}
+
+	study := results[0]
+	if want, got := "data.desc", study.Field; want != got {
+		t.Errorf("want field %s, got %s", want, got)
+	}
+	if want, got := "Filmed with the high-speed biplanar rig.",
+		study.Snippet; want != got {
+		t.Errorf("want snippet %q, got %q", want, got)
+	}
+	if study.Study != "" || study.Trial != "" {
+		t.Errorf("want no context for study, got %q, %q", study.Study,
+			study.Trial)
+	}
+
+	file := results[1]
+	if file.Study != "/studies/a" || file.Trial != "/studies/a/trials/t1" {
+		t.Errorf("want file in /studies/a/trials/t1, got %q, %q",
+			file.Study, file.Trial)
+	}
+	if !strings.HasPrefix(file.Snippet, "…") ||
+		!strings.HasSuffix(file.Snippet, "…") ||
+		!strings.Contains(file.Snippet, "Biplanar rig reset.") {
+		t.Errorf("want excerpt around match, got %q", file.Snippet)
+	}
+	if want, got := "data.notes.1", results[2].Field; want != got {
+		t.Errorf("want field %s, got %s", want, got)
+	}
+	if want, got := "/studies/a", results[2].Study; want != got {
+		t.Errorf("want study %s, got %s", want, got)
+	}
+
+	// The index follows updates and deletes.
+	res := send(t, "PUT", srv.addr+"/studies/a/trials/t1",
+		strings.NewReader(`{"notes":["treadmill"]}`))
+	res.Body.Close()
+	status(t, "DELETE", srv.addr+"/files/a/t1/f1")
+	for _, tt := range []struct {
+		q    string
+		want []string
+	}{
+		{"rig", []string{"/studies/a"}},
+		// Equally relevant hits are ordered by id.
+		{"TREADMILL", []string{"/studies/a/trials/t1", "/studies/b"}},
+		{"rat", nil},
+		{"video", []string{"/studies/b/files/f2"}},
+	} {
+		var got []string
+		for _, r := range searchFor(t, srv.addr, tt.q) {
+			got = append(got, r.ID)
+		}
+		if !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("search %q: want %v, got %v", tt.q, tt.want, got)
+		}
+	}
+
+	res = send(t, "GET", srv.addr+"/search?q=treadmill&limit=1", nil)
+	results = nil
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if want, got := 1, len(results); want != got {
+		t.Errorf("want %d hit, got %d", want, got)
+	}
+
+	for _, query := range []string{"", "?q=", "?q=--", "?q=rig&limit=0"} {
+		url := srv.addr + "/search" + query
+		got := status(t, "GET", url)
+		if want := http.StatusBadRequest; want != got {
+			t.Errorf("search %s: want %d, got %d", query, want, got)
+		}
+	}
+}
+
+// searchFor searches for the words in q, returning the results.
+func searchFor(t *testing.T, addr, q string) []SearchResult {
+	res := send(t, "GET", addr+"/search?q="+url.QueryEscape(q), nil)
+	defer res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Fatalf("search %q: want %d, got %d", q, want, got)
+	}
+	var results []SearchResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatalf("error decoding search %q: %v", q, err)
+	}
+	return results
+}
@@ -0,0 +1,109 @@
+package xhub
+
+import "bytes"
+
+/* -- STORE -- */
+
+// A Store persists the json-encoded data of xhub resources.
+//
+// Items are grouped into named buckets (e.g., "studies") and identified
+// within a bucket by a key, which for resources is the resource id
+// (e.g., "/studies/STUDY_A/trials/TRIAL_1").  Keys are hierarchical, with
+// path segments separated by a slash, so a store can list the children of
+// a key or delete the subtree rooted at it.  Both operations work on whole
+// segments: the children of "/studies/a" never include "/studies/ab".
+//
+// Each method of a store operates in a transaction of its own.  Use View or
+// Update to perform several operations in a single transaction.
+type Store interface {
+	Tx
+
+	// View calls fn with a read-only transaction.  Any error returned by
+	// fn is returned.
+	View(fn func(Tx) error) error
+
+	// Update calls fn with a read-write transaction, committing it if fn
+	// returns nil.  If fn returns an error, none of its changes are made
+	// and the error is returned.
+	//
+	// The store itself must not be used within fn.
+	Update(fn func(Tx) error) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// A Tx provides the operations on a store's items available within a
+// transaction.
+type Tx interface {
+	// Get returns the value stored under key in bucket, or nil if the
+	// key does not exist.
+	Get(bucket, key []byte) ([]byte, error)
+
+	// Put stores value under key in bucket, replacing any existing value.
+	Put(bucket, key, value []byte) error
+
+	// Delete removes key from bucket.  Deleting a missing key is not an
+	// error.
+	Delete(bucket, key []byte) error
+
+	// Children returns the items in bucket that are direct children of
+	// parent (i.e., whose keys extend parent by exactly one segment), in
+	// key order.
+	Children(bucket, parent []byte) ([]Item, error)
+
+	// EachChild calls fn for each item in bucket that is a direct child of
+	// parent, in key order, without gathering the items first.  Iteration
+	// stops at the first error returned by fn, which is returned.
+	EachChild(bucket, parent []byte, fn func(Item) error) error
+
+	// EachRange calls fn for each item in bucket whose key is at least
+	// from and less than to (or unbounded, if to is nil), in key order,
+	// seeking to from rather than visiting the keys before it.  Iteration
+	// stops at the first error returned by fn, which is returned.
+	EachRange(bucket, from, to []byte, fn func(Item) error) error
+
+	// DeleteTree removes root and all of its descendants from bucket,
+	// returning the items removed, in key order.
+	DeleteTree(bucket, root []byte) ([]Item, error)
+
+	// Items returns all items in bucket, in key order.
+	Items(bucket []byte) ([]Item, error)
+}
+
+// An Item is a key/value pair held in a Store bucket.
+type Item struct {
+	Key   []byte
+	Value []byte
+}
+
+// Names of the buckets used by our controllers.
+var (
+	studiesBucket   = []byte("studies")   // resource data, keyed by id
+	studylistBucket = []byte("studylist") // study ids, with creation times
+	metaBucket      = []byte("meta")      // storage layout information
+	trashBucket     = []byte("trash")     // deleted resources, see moveToTrash
+	historyBucket   = []byte("history")   // resource revisions, see historyKey
+	indexBucket     = []byte("index")     // index entries, see Indexes
+	searchBucket    = []byte("search")    // search index, see updateSearch
+
+	idempotencyBucket = []byte("idempotency") // responses, see serveIdempotent
+	schemaBucket      = []byte("schemas")     // data schemas, see checkData
+	templateBucket    = []byte("templates")   // trial templates, see Template
+)
+
+// descendantPrefix returns the key prefix shared by all descendants of key
+// (i.e., key followed by a separator).
+func descendantPrefix(key []byte) []byte {
+	key = bytes.TrimRight(key, "/")
+	prefix := make([]byte, len(key), len(key)+1)
+	copy(prefix, key)
+	return append(prefix, '/')
+}
+
+// isChild reports whether key, which is known to begin with the
+// descendant prefix of its parent, is a direct child of that parent.
+func isChild(prefix, key []byte) bool {
+	rest := key[len(prefix):]
+	return len(rest) > 0 && bytes.IndexByte(rest, '/') == -1
+}
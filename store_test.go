@@ -0,0 +1,287 @@
+package xhub_test
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joyrexus/xhub"
+)
+
+// Ensure each store backend satisfies the Store contract.
+func TestStores(t *testing.T) {
+	dbpath := tempfile()
+	defer os.Remove(dbpath)
+
+	bux, err := xhub.OpenBucketStore(dbpath)
+	if err != nil {
+		t.Fatalf("error opening bucket store: %v", err)
+	}
+
+	for name, store := range map[string]xhub.Store{
+		"bucket": bux,
+		"memory": xhub.NewMemStore(),
+	} {
+		testStore(t, name, store)
+		if err := store.Close(); err != nil {
+			t.Errorf("%s: error closing store: %v", name, err)
+		}
+	}
+}
+
+func testStore(t *testing.T, name string, store xhub.Store) {
+	bucket := []byte("studies")
+
+	// Missing keys have nil values.
+	got, err := store.Get(bucket, []byte("/studies/a"))
+	if err != nil {
+		t.Errorf("%s: error getting missing key: %v", name, err)
+	}
+	if got != nil {
+		t.Errorf("%s: want nil, got %q", name, got)
+	}
+
+	/* -- PUT/GET -- */
+
+	for _, key := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/trials/t10",
+		"/studies/a/trials/t2",
+		"/studies/ab",
+		"/studies/ab/trials/t1",
+		"/studies/b",
+	} {
+		if err := store.Put(bucket, []byte(key), []byte(key)); err != nil {
+			t.Errorf("%s: error putting %q: %v", name, key, err)
+		}
+	}
+
+	got, err = store.Get(bucket, []byte("/studies/a"))
+	if err != nil {
+		t.Errorf("%s: error getting key: %v", name, err)
+	}
+	if want := "/studies/a"; string(got) != want {
+		t.Errorf("%s: want %q, got %q", name, want, got)
+	}
+
+	/* -- CHILDREN -- */
+
+	// Only direct children are listed.
+	items, err := store.Children(bucket, []byte("/studies"))
+	if err != nil {
+		t.Errorf("%s: error listing children: %v", name, err)
+	}
+	want := []string{"/studies/a", "/studies/ab", "/studies/b"}
+	if got := keys(items); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v, got %v", name, want, got)
+	}
+
+	items, err = store.Children(bucket, []byte("/studies/a/trials"))
+	if err != nil {
+		t.Errorf("%s: error listing children: %v", name, err)
+	}
+	want = []string{
+		"/studies/a/trials/t1",
+		"/studies/a/trials/t10",
+		"/studies/a/trials/t2",
+	}
+	if got := keys(items); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v, got %v", name, want, got)
+	}
+
+	// Children can be visited one by one, stopping early.
+	var visited []xhub.Item
+	stop := fmt.Errorf("stop")
+	err = store.EachChild(bucket, []byte("/studies/a/trials"),
+		func(item xhub.Item) error {
+			visited = append(visited, item)
+			if len(visited) == 2 {
+				return stop
+			}
+			return nil
+		})
+	if err != stop {
+		t.Errorf("%s: want error %v, got %v", name, stop, err)
+	}
+	want = []string{"/studies/a/trials/t1", "/studies/a/trials/t10"}
+	if got := keys(visited); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v visited, got %v", name, want, got)
+	}
+
+	/* -- RANGE -- */
+
+	// Ranges include their lower bound but not their upper bound.
+	visited = nil
+	err = store.EachRange(bucket, []byte("/studies/a/trials/t10"),
+		[]byte("/studies/b"), func(item xhub.Item) error {
+			visited = append(visited, item)
+			return nil
+		})
+	if err != nil {
+		t.Errorf("%s: error visiting range: %v", name, err)
+	}
+	want = []string{
+		"/studies/a/trials/t10",
+		"/studies/a/trials/t2",
+		"/studies/ab",
+		"/studies/ab/trials/t1",
+	}
+	if got := keys(visited); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v visited, got %v", name, want, got)
+	}
+
+	// Ranges without an upper bound run to the end of the bucket.
+	visited = nil
+	err = store.EachRange(bucket, []byte("/studies/ab/"), nil,
+		func(item xhub.Item) error {
+			visited = append(visited, item)
+			return nil
+		})
+	if err != nil {
+		t.Errorf("%s: error visiting range: %v", name, err)
+	}
+	want = []string{"/studies/ab/trials/t1", "/studies/b"}
+	if got := keys(visited); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v visited, got %v", name, want, got)
+	}
+
+	/* -- DELETE -- */
+
+	if err := store.Delete(bucket, []byte("/studies/b")); err != nil {
+		t.Errorf("%s: error deleting key: %v", name, err)
+	}
+	if got, _ := store.Get(bucket, []byte("/studies/b")); got != nil {
+		t.Errorf("%s: want nil after delete, got %q", name, got)
+	}
+
+	// Deleting a missing key is not an error.
+	if err := store.Delete(bucket, []byte("/studies/b")); err != nil {
+		t.Errorf("%s: error deleting missing key: %v", name, err)
+	}
+
+	/* -- DELETE TREE -- */
+
+	// Deleting a trial leaves trials sharing its name as a prefix.
+	root := []byte("/studies/a/trials/t1")
+	deleted, err := store.DeleteTree(bucket, root)
+	if err != nil {
+		t.Errorf("%s: error deleting tree: %v", name, err)
+	}
+	want = []string{"/studies/a/trials/t1"}
+	if got := keys(deleted); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v deleted, got %v", name, want, got)
+	}
+	items, err = store.Children(bucket, []byte("/studies/a/trials"))
+	if err != nil {
+		t.Errorf("%s: error listing children: %v", name, err)
+	}
+	want = []string{"/studies/a/trials/t10", "/studies/a/trials/t2"}
+	if got := keys(items); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v, got %v", name, want, got)
+	}
+
+	// Deleting a study leaves studies sharing its name as a prefix.
+	deleted, err = store.DeleteTree(bucket, []byte("/studies/a"))
+	if err != nil {
+		t.Errorf("%s: error deleting tree: %v", name, err)
+	}
+	want = []string{
+		"/studies/a",
+		"/studies/a/trials/t10",
+		"/studies/a/trials/t2",
+	}
+	if got := keys(deleted); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v deleted, got %v", name, want, got)
+	}
+	items, err = store.Items(bucket)
+	if err != nil {
+		t.Errorf("%s: error listing items: %v", name, err)
+	}
+	want = []string{"/studies/ab", "/studies/ab/trials/t1"}
+	if got := keys(items); !reflect.DeepEqual(want, got) {
+		t.Errorf("%s: want %v, got %v", name, want, got)
+	}
+}
+
+// Ensure migrations drop studylist entries for unreachable studies.
+func TestMigrate(t *testing.T) {
+	store := xhub.NewMemStore()
+	studies, studylist := []byte("studies"), []byte("studylist")
+
+	// Setup the aftermath of deleting "/studies/a" in an older version:
+	// the data of "/studies/ab" is gone, but its studylist entry remains.
+	now := []byte(time.Now().Format(time.RFC3339Nano))
+	for _, key := range []string{
+		"/studies/ab", "/studies/b", "/studies/x", "bogus",
+	} {
+		if err := store.Put(studylist, []byte(key), now); err != nil {
+			t.Fatalf("error putting %q: %v", key, err)
+		}
+	}
+	if err := store.Put(studies, []byte("/studies/b"), []byte("{}")); err != nil {
+		t.Fatalf("error putting study: %v", err)
+	}
+	// Studies posted without a data payload were stored with an empty value.
+	if err := store.Put(studies, []byte("/studies/x"), nil); err != nil {
+		t.Fatalf("error putting study: %v", err)
+	}
+
+	if err := xhub.Migrate(store); err != nil {
+		t.Fatalf("error migrating store: %v", err)
+	}
+
+	items, err := store.Items(studylist)
+	if err != nil {
+		t.Errorf("error listing studylist: %v", err)
+	}
+	want := []string{"/studies/b", "/studies/x"}
+	if got := keys(items); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// The study's data payload is wrapped as its first revision, stamped
+	// with the creation time from its studylist entry.
+	data, err := store.Get(studies, []byte("/studies/b"))
+	if err != nil {
+		t.Errorf("error getting study: %v", err)
+	}
+	rec := fmt.Sprintf(`{"rev":1,"created":%q,"modified":%q,"data":{}}`,
+		now, now)
+	if got := string(data); rec != got {
+		t.Errorf("want %s, got %s", rec, got)
+	}
+
+	// Empty values are wrapped as null payloads.
+	data, err = store.Get(studies, []byte("/studies/x"))
+	if err != nil {
+		t.Errorf("error getting study: %v", err)
+	}
+	rec = fmt.Sprintf(`{"rev":1,"created":%q,"modified":%q,"data":null}`,
+		now, now)
+	if got := string(data); rec != got {
+		t.Errorf("want %s, got %s", rec, got)
+	}
+
+	// Migrations are only applied once.
+	if err := store.Put(studylist, []byte("/studies/c"), now); err != nil {
+		t.Fatalf("error putting study: %v", err)
+	}
+	if err := xhub.Migrate(store); err != nil {
+		t.Fatalf("error migrating store: %v", err)
+	}
+	if got, _ := store.Get(studylist, []byte("/studies/c")); got == nil {
+		t.Errorf("want studylist entry to survive a second migration")
+	}
+}
+
+// keys returns the keys of the given items.
+func keys(items []xhub.Item) []string {
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, string(item.Key))
+	}
+	return keys
+}
@@ -0,0 +1,97 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// ndjsonType is the media type of newline-delimited json, in which each
+// line is a json document.
+const ndjsonType = "application/x-ndjson"
+
+// streamChunk is the number of resources read from the store in each
+// transaction of a stream, and streamed between flushes of the response.
+const streamChunk = 100
+
+// streamResources handles GET requests for the collection at parent that
+// accept newline-delimited json, streaming each of its resources of type
+// typ on a line of its own as they're read from the store, rather than
+// building the whole list first.  The resources are filtered, expanded,
+// and reduced to the fields requested as in a list (see listResources).
+// Streamed resources are always ordered by id and can't be limited, but a
+// stream can be resumed after the last resource received with the after
+// parameter.  The resources are read in chunks (see streamChunk), each in
+// a transaction of its own, so that a slow client doesn't hold a
+// transaction open for the length of the stream.
+func streamResources(w http.ResponseWriter, r *http.Request, host string,
+	store Store, typ, parent string, depth int, p *page, where filter) {
+
+	if p.sort != "id" || p.limit > 0 {
+		writeError(w, r, http.StatusBadRequest, "streamed lists are "+
+			"ordered by id and can't be limited")
+		return
+	}
+	fields, err := fieldsParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n := 0 // number of resources streamed
+	chunk := &page{limit: streamChunk, after: p.after, sort: "id"}
+	for more := true; more && err == nil; {
+		var ids []string // ids of the resources read, and their values
+		var values []interface{}
+		err = store.View(func(tx Tx) error {
+			var listings []listing
+			var err error
+			listings, more, err = chunk.list(tx, parent, where)
+			if err != nil {
+				return err
+			}
+			for _, l := range listings {
+				rsc := newResource(host, typ, l.id, l.rec)
+				rsc.Children, err = childIDs(tx, l.id, depth)
+				if err != nil {
+					return err
+				}
+				v, err := fields.apply(rsc)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, l.id)
+				values = append(values, v)
+			}
+			return nil
+		})
+		for i := 0; i < len(values) && err == nil; i++ {
+			if n == 0 {
+				w.Header().Set("Content-Type", ndjsonType)
+			}
+			if err = enc.Encode(values[i]); err != nil {
+				err = fmt.Errorf("couldn't stream %s: %v", ids[i], err)
+			}
+			chunk.after = ids[i]
+			n++
+		}
+		if flusher != nil && n > 0 && err == nil {
+			flusher.Flush()
+		}
+	}
+	switch {
+	case err != nil && n == 0:
+		fail(w, r, err)
+	case err != nil:
+		// The response is underway, so abort it to let the client know
+		// the stream is incomplete.
+		log.Printf("error streaming %s: %v\n", parent, err)
+		panic(http.ErrAbortHandler)
+	case n == 0:
+		w.Header().Set("Content-Type", ndjsonType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
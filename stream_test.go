@@ -0,0 +1,82 @@
+package xhub_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure lists can be streamed as newline-delimited json.
+func TestStream(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	var want []string
+	for i := 1; i <= 250; i++ {
+		path := fmt.Sprintf("/studies/a/files/f%03d", i)
+		doc := fmt.Sprintf(`{"n":%d}`, i)
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+		want = append(want, path)
+	}
+
+	got := stream(t, srv.addr+"/studies/a/files")
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %d files streamed, got %d", len(want), len(got))
+	}
+
+	// Streams can be filtered and resumed.
+	url := srv.addr + "/studies/a/files?where=data.n%3E240" +
+		"&after=/studies/a/files/f245"
+	want = want[245:]
+	if got := stream(t, url); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// Empty collections stream nothing.
+	if got := stream(t, srv.addr+"/studies/b/trials"); len(got) != 0 {
+		t.Errorf("want nothing streamed, got %v", got)
+	}
+
+	header := map[string]string{"Accept": "application/x-ndjson"}
+	for _, query := range []string{"?limit=10", "?sort=natural", "?fields=x"} {
+		url := srv.addr + "/studies/a/files" + query
+		res := sendWith(t, "GET", url, header, nil)
+		res.Body.Close()
+		if want, got := http.StatusBadRequest, res.StatusCode; want != got {
+			t.Errorf("stream %s: want %d, got %d", query, want, got)
+		}
+	}
+}
+
+// stream requests a stream of the resources listed at url, returning the
+// ids of the resources received.
+func stream(t *testing.T, url string) []string {
+	header := map[string]string{"Accept": "application/x-ndjson"}
+	res := sendWith(t, "GET", url, header, nil)
+	defer res.Body.Close()
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Fatalf("stream %s: want %d, got %d", url, want, got)
+	}
+	want := "application/x-ndjson"
+	if got := res.Header.Get("Content-Type"); want != got {
+		t.Errorf("want content type %s, got %s", want, got)
+	}
+	ids := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var item Item
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			t.Fatalf("error decoding line %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, item.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("error reading stream: %v", err)
+	}
+	return ids
+}
@@ -3,11 +3,9 @@ package xhub
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
-	"github.com/joyrexus/buckets"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -17,88 +15,123 @@ type Study struct {
 }
 
 // NewStudyController initializes a new instance of our study controller.
-func NewStudyController(host string, bux *buckets.DB) *StudyController {
-	// Create/open bucket for storing study-related data.
-	studies, err := bux.New([]byte("studies"))
-	if err != nil {
-		log.Fatalf("couldn't create/open studies bucket: %v\n", err)
-	}
+func NewStudyController(host string, store Store,
+	config *Config) *StudyController {
 
-	// Create/open bucket for storing list of study IDs.
-	studylist, err := bux.New([]byte("studylist"))
-	if err != nil {
-		log.Fatalf("couldn't create/open studylist bucket: %v\n", err)
-	}
-
-	return &StudyController{host, studies, studylist}
+	return &StudyController{host, store, config}
 }
 
 // A StudyController handles requests for study resources.
+//
+// Study data is kept in the store's studies bucket, alongside the data of
+// each study's trials and files.  The studylist bucket holds the id of
+// each study along with its creation time.
 type StudyController struct {
-	host      string
-	studies   *buckets.Bucket
-	studylist *buckets.Bucket
+	host   string
+	store  Store
+	config *Config
 }
 
 // Post handles POST requests for `/studies`, storing the study data sent.
 func (c *StudyController) Post(w http.ResponseWriter, r *http.Request,
 	_ httprouter.Params) {
 
-	var study Resource
-	err := json.NewDecoder(r.Body).Decode(&study)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	key := []byte(study.ID)
+	postResource(w, r, c.store, "study", "/studies", listStudy)
+}
+
+// listStudy adds the new study id to the studylist bucket, along with its
+// creation time.
+func listStudy(tx Tx, id string) error {
 	now := []byte(time.Now().Format(time.RFC3339Nano))
-	if c.studylist.Put(key, now); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	if err := c.studies.Put(key, study.Data); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	w.WriteHeader(http.StatusCreated)
+	return tx.Put(studylistBucket, []byte(id), now)
 }
 
 // List handles GET requests for `/studies`, returning a list of
-// available studies.
+// available studies, optionally along with the ids of their trials and
+// files.  The studies are filtered and the list paginated as requested
+// (see whereParam and pageParam).
 func (c *StudyController) List(w http.ResponseWriter, r *http.Request,
 	_ httprouter.Params) {
 
-	// Retrieve studylist items (study-id/creation-time pairs)
-	items, err := c.studylist.Items()
+	depth, err := depthParam(r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := pageParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, err := whereParam(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	resources := []*Resource{}
+	next := "" // id of the last resource on the page, if more follow
 
-	// Append each item to the list of resources.
-	for _, study := range items {
-		data, err := c.studies.Get(study.Key)
+	err = c.store.View(func(tx Tx) error {
+		// Retrieve studylist items (study-id/creation-time pairs)
+		items, err := tx.Children(studylistBucket, []byte("/studies"))
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
-		id := string(study.Key)
-		url := "http://" + c.host + id
-		rsc := &Resource{
-			Version: "1",
-			Type:    "study",
-			ID:      id,
-			URL:     url,
-			Data:    data,
-			Created: string(study.Value),
+		listings := []listing{}
+		for _, study := range items {
+			l := listing{id: string(study.Key),
+				created: createdTime(string(study.Value))}
+			if len(where) > 0 {
+				// Filtering requires the study's record up front.
+				if l.rec, err = getRecord(tx, l.id); err != nil {
+					return err
+				}
+				if l.rec == nil {
+					continue
+				}
+				if ok, err := where.match(l.rec); !ok || err != nil {
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			listings = append(listings, l)
+		}
+		listings, more, err := p.apply(listings)
+		if err != nil {
+			return err
 		}
-		resources = append(resources, rsc)
+		if more {
+			next = listings[len(listings)-1].id
+		}
+
+		// Append each study on the page to the list of resources.
+		for _, study := range listings {
+			rec := study.rec
+			if rec == nil {
+				if rec, err = getRecord(tx, study.id); err != nil {
+					return err
+				}
+			}
+			if rec == nil {
+				continue
+			}
+			rsc := newResource(c.host, "study", study.id, rec)
+			if rsc.Children, err = childIDs(tx, study.id, depth); err != nil {
+				return err
+			}
+			resources = append(resources, rsc)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resources)
+	writePage(w, r, c.host, resources, next)
 }
 
 // Get handles GET requests for `/studies/:study`, returning the raw json
@@ -108,61 +141,117 @@ func (c *StudyController) Get(w http.ResponseWriter, r *http.Request,
 
 	study := p.ByName("study")
 	id := fmt.Sprintf("/studies/%s", study)
-	data, err := c.studies.Get([]byte(id))
+	getResource(w, r, c.host, c.store, c.config, "study", id)
+}
+
+// Tree handles GET requests for `/studies/:study/tree`, returning the
+// requested study along with all of its files and trials (and their files)
+// as a single nested json document.  Each resource in the tree is reduced
+// to the fields requested, if any (see fieldsParam).
+func (c *StudyController) Tree(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	fields, err := fieldsParam(r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	if data == nil {
-		http.Error(w, id+" not found", http.StatusNoContent)
+
+	id := "/studies/" + p.ByName("study")
+	var tree *Tree
+	err = c.store.View(func(tx Tx) error {
+		rec, err := getRecord(tx, id)
+		if err != nil || rec == nil {
+			return err
+		}
+		tree, err = buildTree(tx, c.host, "study", id, rec)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	if tree == nil {
+		c.config.notFound(w, r, id)
+		return
+	}
+	v, err := fields.apply(tree)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeTagged(w, r, v)
 }
 
-// Delete handles DELETE requests for `/studies/:study`, deleting the entries
-// for the given study.  All items associated with the specified study are
-// deleted, both its trial and file resources.
-func (c *StudyController) Delete(w http.ResponseWriter, r *http.Request,
+// Put handles PUT requests for `/studies/:study`, replacing the json data
+// payload of the requested study with the json document sent.  The study
+// is created if it doesn't exist yet.
+func (c *StudyController) Put(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	study := p.ByName("study")
-	// Delete all items associated with study.
-	if err := c.DeleteChildItems(study); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	// Delete item in studylist bucket.
-	key := []byte("/studies/" + study)
-	if err := c.studylist.Delete(key); err != nil {
-		http.Error(w, err.Error(), 500)
+	if err := ValidateName(study); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	putResource(w, r, c.store, "/studies/"+study, listStudy)
 }
 
-// DeleteChildItems deletes all items in the studies bucket with a prefix
-// of `/studies/:study` or `/files/:study`.
-func (c *StudyController) DeleteChildItems(study string) error {
-	for _, pre := range []string{"/studies/", "/files/"} {
-		prefix := []byte(pre + study)
-		items, err := c.studies.PrefixItems(prefix)
-		if err != nil {
-			return fmt.Errorf("couldn't retrieve items with prefix %q: %v",
-				prefix,
-				err,
-			)
-		}
-		for _, item := range items {
-			if err := c.studies.Delete(item.Key); err != nil {
-				return fmt.Errorf("couldn't delete item %q: %v", item.Key, err)
-			}
-		}
-	}
-	return nil
+// Patch handles PATCH requests for `/studies/:study`, applying the patch
+// document sent (either a json merge patch or a json patch) to the json
+// data payload of the requested study.
+func (c *StudyController) Patch(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	patchResource(w, r, c.store, "/studies/"+p.ByName("study"))
+}
+
+// Delete handles DELETE requests for `/studies/:study`, moving the entries
+// for the given study to the trash.  All items associated with the
+// specified study are deleted, both its trial and file resources, along
+// with its studylist entry.
+func (c *StudyController) Delete(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	deleteResources(w, r, c.store, c.config, id, trashRoots(id))
+}
+
+// History handles GET requests for `/studies/:study/history`, returning a
+// list of the revisions of the requested study.
+func (c *StudyController) History(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	listHistory(w, r, c.host, c.store, c.config, id)
+}
+
+// Revision handles GET requests for `/studies/:study/history/:rev`,
+// returning the raw json data payload of the requested revision of the
+// study.
+func (c *StudyController) Revision(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	getHistory(w, r, c.host, c.store, c.config, "study", id, p.ByName("rev"))
+}
+
+// Diff handles GET requests for `/studies/:study/diff`, returning a json
+// patch between the revisions of the requested study given by the from
+// and to parameters.
+func (c *StudyController) Diff(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	diffHistory(w, r, c.store, "/studies/"+p.ByName("study"))
+}
+
+// Revert handles POST requests for `/studies/:study/revert`, restoring the
+// revision of the requested study given by the rev parameter as a new
+// revision.
+func (c *StudyController) Revert(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	revertResource(w, r, c.store, "/studies/"+p.ByName("study"))
 }
 
 // View handles GET requests for `/view/studies/:study`, returning a web
@@ -171,18 +260,18 @@ func (c *StudyController) View(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	id := "/studies/" + p.ByName("study")
-	data, err := c.studies.Get([]byte(id))
+	rec, err := loadRecord(c.store, id)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	if data == nil {
-		http.Error(w, id+" not found", http.StatusNoContent)
+	if rec == nil {
+		http.Error(w, id+" not found", http.StatusNotFound)
 		return
 	}
 
 	var study Study
-	if err := json.Unmarshal(data, &study); err != nil {
+	if err := json.Unmarshal(rec.Data, &study); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -199,18 +288,18 @@ func (c *StudyController) Edit(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	id := "/studies/" + p.ByName("study")
-	data, err := c.studies.Get([]byte(id))
+	rec, err := loadRecord(c.store, id)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	if data == nil {
-		http.Error(w, id+" not found", http.StatusNoContent)
+	if rec == nil {
+		http.Error(w, id+" not found", http.StatusNotFound)
 		return
 	}
 
 	var study Study
-	if err := json.Unmarshal(data, &study); err != nil {
+	if err := json.Unmarshal(rec.Data, &study); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -220,29 +309,44 @@ func (c *StudyController) Edit(w http.ResponseWriter, r *http.Request,
 		http.Error(w, err.Error(), 500)
 	}
 }
-// Save handles POST requests for `/save/studies`, storing the study data sent.
+
+// Save handles POST requests for `/save/studies/:study`, updating the
+// description of the requested study with the one submitted from the
+// study's edit page.
 func (c *StudyController) Save(w http.ResponseWriter, r *http.Request,
-	_ httprouter.Params) {
+	p httprouter.Params) {
 
-	fmt.Println(r.FormValue("desc"))
-	/*
-	study Resource
-	err := json.NewDecoder(r.Body).Decode(&study)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	key := []byte(study.ID)
-	now := []byte(time.Now().Format(time.RFC3339Nano))
-	if c.studylist.Put(key, now); err != nil {
-		http.Error(w, err.Error(), 500)
+	id := "/studies/" + p.ByName("study")
+	err := c.store.Update(func(tx Tx) error {
+		old, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return errorf(http.StatusNotFound, "%s not found", id)
+		}
+
+		// Merge the submitted description into the study's data payload,
+		// leaving any other fields as they were.
+		doc, err := decodeJSON(old.Data)
+		if err != nil {
+			return err
+		}
+		patch := map[string]interface{}{"desc": r.FormValue("desc")}
+		data, err := json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			return err
+		}
+		_, err = putRecord(tx, id, old, data, author(r))
+		return err
+	})
+	if e, ok := err.(*statusError); ok {
+		http.Error(w, e.Error(), e.status)
 		return
 	}
-	if err := c.studies.Put(key, study.Data); err != nil {
+	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	*/
-	w.WriteHeader(http.StatusCreated)
+	http.Redirect(w, r, "/view"+id, http.StatusSeeOther)
 }
-
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/joyrexus/xhub"
 )
 
 func TestStudyMissing(t *testing.T) {
@@ -48,8 +51,8 @@ func TestStudyMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 
@@ -70,8 +73,8 @@ func TestStudyMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// No harm done.
-	if want, got := http.StatusOK, res.StatusCode; want != got {
+	// Missing resources can't be deleted.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -144,7 +147,7 @@ func TestStudyPersistence(t *testing.T) {
 	// Check expected URL of the one posted study resource.
 	studyURL := "http://localhost:8081/studies/test_study"
 	if want, got := studyURL, items[0].URL; want != got {
-		t.Errorf("want %d item, got %d", want, got)
+		t.Errorf("want %s, got %s", want, got)
 	}
 
 	/* -- GET -- */
@@ -201,8 +204,8 @@ func TestStudyPersistence(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -426,8 +429,8 @@ func TestStudyDelete(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 
@@ -443,8 +446,8 @@ func TestStudyDelete(t *testing.T) {
 		}
 		res.Body.Close()
 
-		// Ensure we get a StatusNoContent (204) response.
-		if want, got := http.StatusNoContent, res.StatusCode; want != got {
+		// Ensure we get a StatusNotFound (404) response.
+		if want, got := http.StatusNotFound, res.StatusCode; want != got {
 			t.Errorf(
 				"want status code %d, but got %d when getting %s",
 				want, got, url,
@@ -452,3 +455,105 @@ func TestStudyDelete(t *testing.T) {
 		}
 	}
 }
+
+// Ensure deleting a study leaves studies whose names it prefixes alone.
+func TestStudyDeleteSiblings(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, id := range []string{"study_1", "study_10"} {
+		study := &Resource{
+			Version: "1",
+			Type:    "study",
+			ID:      "/studies/" + id,
+			Data:    map[string]string{"name": id},
+			Created: time.Now(),
+		}
+		url := srv.addr + "/studies"
+		if want, got := http.StatusCreated, post(t, url, study); want != got {
+			t.Errorf("want %d, got %d", want, got)
+		}
+		file := &Resource{
+			Version: "1",
+			Type:    "file",
+			ID:      "/studies/" + id + "/files/test_file",
+			Data:    map[string]string{"name": "test_file"},
+			Created: time.Now(),
+		}
+		url = srv.addr + "/studies/" + id + "/files"
+		if want, got := http.StatusCreated, post(t, url, file); want != got {
+			t.Errorf("want %d, got %d", want, got)
+		}
+	}
+
+	url := srv.addr + "/studies/study_1"
+	if want, got := http.StatusOK, status(t, "DELETE", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+
+	// Ensure study_10 and its file survived.
+	for _, id := range []string{
+		"/studies/study_10",
+		"/studies/study_10/files/test_file",
+	} {
+		if want, got := http.StatusOK, status(t, "GET", srv.addr+id); want != got {
+			t.Errorf("want %d, got %d getting %s", want, got, id)
+		}
+	}
+}
+
+// Ensure deleting a study deletes its trials and files all at once,
+// summarizing what was deleted.
+func TestStudyDeleteSummary(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/trials/t2",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+		"/files/a/t2/f3",
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(`{}`))
+		res.Body.Close()
+	}
+	url := srv.addr + "/studies/a"
+
+	// A failed precondition leaves everything in place.
+	header := map[string]string{"If-Match": `"2"`}
+	res := sendWith(t, "DELETE", url, header, nil)
+	res.Body.Close()
+	if want, got := http.StatusPreconditionFailed, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	path := "/files/a/t2/f3"
+	if want, got := http.StatusOK, status(t, "GET", srv.addr+path); want != got {
+		t.Errorf("GET %s: want %d, got %d", path, want, got)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want xhub.Summary
+	}{
+		{"/files/a/t2/f3", xhub.Summary{ID: "/files/a/t2/f3", Files: 1}},
+		{"/studies/a/trials/t2", xhub.Summary{
+			ID: "/studies/a/trials/t2", Trials: 1}},
+		{"/studies/a", xhub.Summary{ID: "/studies/a", Trials: 1, Files: 2}},
+	} {
+		res := send(t, "DELETE", srv.addr+tt.path, nil)
+		var got xhub.Summary
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatalf("error decoding summary: %v", err)
+		}
+		res.Body.Close()
+		if want := tt.want; want != got {
+			t.Errorf("DELETE %s: want %+v, got %+v", tt.path, want, got)
+		}
+	}
+	if want, got := http.StatusNotFound,
+		status(t, "DELETE", srv.addr+"/studies/a"); want != got {
+		t.Errorf("DELETE deleted study: want %d, got %d", want, got)
+	}
+}
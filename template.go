@@ -0,0 +1,409 @@
+package xhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Each study can carry a template for the data payloads of its trials,
+// kept in the store's templates bucket under the study id.  The defaults
+// of a template are merged under the data payload of each trial written
+// to the study (see applyTemplate), which must then hold a value at each
+// of the template's required paths.  The record of each trial lists the
+// paths of the values it inherits from the template, so that resolving
+// the trial can tell them from the values sent by clients.
+
+// NewTemplateController initializes a new instance of our template
+// controller.
+func NewTemplateController(host string, store Store,
+	config *Config) *TemplateController {
+
+	return &TemplateController{host, store, config}
+}
+
+// A TemplateController handles requests for the trial templates of
+// studies.
+type TemplateController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// getTemplate returns the trial template of the study id, or nil if the
+// study has none.
+func getTemplate(tx Tx, id string) (*Template, error) {
+	v, err := tx.Get(templateBucket, []byte(id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	t := new(Template)
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseTemplate decodes and checks the json-encoded template data: its
+// defaults must be an object, and its required paths valid paths within a
+// data payload.
+func parseTemplate(data []byte) (*Template, error) {
+	t := new(Template)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(t); err != nil {
+		return nil, err
+	}
+	if len(t.Defaults) > 0 {
+		defaults, err := decodeJSON(t.Defaults)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := defaults.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("defaults must be an object")
+		}
+	}
+	for _, path := range t.Required {
+		if _, err := parsePath("data." + path); err != nil {
+			return nil, fmt.Errorf("invalid required path %q: %v", path, err)
+		}
+	}
+	return t, nil
+}
+
+// leafPaths returns the paths of the values within the decoded json value
+// v, found at path: the paths of the members of objects, recursively, and
+// the path of any other value (including an empty object).
+func leafPaths(v interface{}, path string) []string {
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(obj) == 0 {
+		return []string{path}
+	}
+	var paths []string
+	for _, name := range sortedKeys(obj) {
+		paths = append(paths, leafPaths(obj[name], path+"."+name)...)
+	}
+	return paths
+}
+
+// mergeUnder returns the decoded json value v, found at path, merged over
+// the defaults d: objects are merged member by member, while other values
+// in v replace those in d.  If flags isn't nil, the path of each value in
+// d (see leafPaths) is flagged as "inherited" if v lacks the value, or
+// "overridden" if v replaces it.
+func mergeUnder(d, v interface{}, path string,
+	flags map[string]string) interface{} {
+
+	dobj, ok := d.(map[string]interface{})
+	vobj, ok2 := v.(map[string]interface{})
+	if !ok || !ok2 {
+		if flags != nil {
+			for _, p := range leafPaths(d, path) {
+				flags[p] = "overridden"
+			}
+		}
+		return v
+	}
+	merged := make(map[string]interface{}, len(vobj))
+	for name, x := range vobj {
+		merged[name] = x
+	}
+	for name, x := range dobj {
+		at := path + "." + name
+		if y, ok := vobj[name]; ok {
+			merged[name] = mergeUnder(x, y, at, flags)
+			continue
+		}
+		merged[name] = deepCopy(x)
+		if flags != nil {
+			for _, p := range leafPaths(x, at) {
+				flags[p] = "inherited"
+			}
+		}
+	}
+	return merged
+}
+
+// keptInherited returns the paths of the values that the resource with the
+// record old inherited from its study's trial template and that the
+// json-encoded data payload leaves as they are: a value stays inherited
+// until a write changes it.
+func keptInherited(old *record, data []byte) ([]string, error) {
+	if old == nil || len(old.Inherited) == 0 || len(data) == 0 {
+		return nil, nil
+	}
+	prev, err := decodeJSON(old.Data)
+	if err != nil {
+		return nil, fmt.Errorf("stored document is invalid: %v", err)
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var kept []string
+	for _, p := range old.Inherited {
+		path, _ := parsePath(p)
+		x, ok := lookup(prev, path)
+		y, ok2 := lookup(doc, path)
+		if ok && ok2 && jsonEqual(x, y) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+// ownData returns a copy of the decoded data payload doc without the
+// values at the inherited paths that the template defaults d define, so
+// that merging doc over d takes those values from d as they are now.
+func ownData(doc, d interface{}, inherited []string) interface{} {
+	own := deepCopy(doc)
+	for _, p := range inherited {
+		path, _ := parsePath(p)
+		if _, ok := lookup(d, path); !ok {
+			continue
+		}
+		if v, _, err := removeValue(own, path); err == nil {
+			own = v
+		}
+	}
+	return own
+}
+
+// applyTemplate returns the json-encoded data payload of the resource id
+// merged over the defaults of its study's trial template, if it's a trial
+// and the study has one, along with the paths of the values it inherits
+// from the template.  Given the resource's current record old (nil if the
+// resource is new), values it inherited that the payload leaves as they
+// are stay inherited, taking on the template's current defaults.  A
+// missing or null payload takes the defaults as they are.  The merged
+// payload must hold a value at each of the template's required paths, or
+// a dataError lists those missing.
+func applyTemplate(tx Tx, id string, old *record,
+	data []byte) ([]byte, []string, error) {
+
+	if resourceType(id) != "trial" {
+		return data, nil, nil
+	}
+	study := "/studies/" + strings.Split(id, "/")[2]
+	t, err := getTemplate(tx, study)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept, err := keptInherited(old, data)
+	if err != nil || t == nil {
+		return data, kept, err
+	}
+
+	var doc interface{}
+	if len(data) > 0 {
+		if doc, err = decodeJSON(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, nil, errorf(http.StatusUnprocessableEntity, "data "+
+			"payload of %s must be an object to apply the study's trial "+
+			"template", id)
+	}
+	var defaults interface{}
+	flags := map[string]string{}
+	if len(t.Defaults) > 0 {
+		if defaults, err = decodeJSON(t.Defaults); err != nil {
+			return nil, nil, err
+		}
+		doc = mergeUnder(defaults, ownData(doc, defaults, kept), "data",
+			flags)
+	}
+
+	var vs []*Violation
+	for _, p := range t.Required {
+		path, _ := parsePath("data." + p)
+		if _, ok := lookup(doc, path); !ok {
+			vs = append(vs, &Violation{"data." + p,
+				"required by the study's trial template"})
+		}
+	}
+	if len(vs) > 0 {
+		return nil, nil, &dataError{id, "the study's trial template", vs}
+	}
+
+	var inherited []string
+	for p, flag := range flags {
+		if flag == "inherited" {
+			inherited = append(inherited, p)
+		}
+	}
+	for _, p := range kept {
+		// values no longer among the defaults stay as they are
+		path, _ := parsePath(p)
+		if _, ok := lookup(defaults, path); !ok {
+			inherited = append(inherited, p)
+		}
+	}
+	sort.Strings(inherited)
+	data, err = json.Marshal(doc)
+	return data, inherited, err
+}
+
+// resolveTrial handles GET requests for the trial id with the `resolved`
+// parameter, returning the trial in an envelope, its data payload merged
+// over the current defaults of its study's trial template (see
+// ResolvedTrial).  Values the trial inherited from an earlier version of
+// the template give way to the current defaults.  The response carries the
+// ETag of the trial's current revision.
+func resolveTrial(w http.ResponseWriter, r *http.Request, host string,
+	store Store, config *Config, id string) {
+
+	var rec *record
+	var t *Template
+	err := store.View(func(tx Tx) (err error) {
+		rec, err = getRecord(tx, id)
+		if err != nil || rec == nil {
+			return err
+		}
+		t, err = getTemplate(tx, "/studies/"+strings.Split(id, "/")[2])
+		return err
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rec == nil {
+		config.notFound(w, r, id)
+		return
+	}
+
+	resolved := &ResolvedTrial{
+		Resource: newResource(host, "trial", id, rec),
+		Template: map[string]string{},
+	}
+	if t != nil && len(t.Defaults) > 0 {
+		defaults, err := decodeJSON(t.Defaults)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		doc, err := decodeJSON(rec.Data)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError,
+				"stored document is invalid: "+err.Error())
+			return
+		}
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+		own := ownData(doc, defaults, rec.Inherited)
+		merged := mergeUnder(defaults, own, "data", resolved.Template)
+		if resolved.Data, err = json.Marshal(merged); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// The resolved view also depends on the template, so the record's ETag
+	// is sent for use in conditional writes, but isn't matched against
+	// If-None-Match.
+	w.Header().Set("ETag", rec.ETag())
+	writeDocument(w, http.StatusOK, append(data, '\n'))
+}
+
+// Get handles GET requests for `/studies/:study/template`, returning the
+// study's trial template.
+func (c *TemplateController) Get(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	data, err := c.store.Get(templateBucket, []byte(id))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if data == nil {
+		c.config.notFound(w, r, id+"/template")
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// Put handles PUT requests for `/studies/:study/template`, setting the
+// study's trial template to the one sent.  Existing trials are left as
+// they are.
+func (c *TemplateController) Put(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	data, err := readDocument(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := parseTemplate(data)
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity,
+			"invalid template: "+err.Error())
+		return
+	}
+	if data, err = json.Marshal(t); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	err = c.store.Update(func(tx Tx) error {
+		rec, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errorf(http.StatusNotFound, "%s not found", id)
+		}
+		old, err := tx.Get(templateBucket, []byte(id))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			status = http.StatusCreated
+		}
+		return tx.Put(templateBucket, []byte(id), data)
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	writeDocument(w, status, data)
+}
+
+// Delete handles DELETE requests for `/studies/:study/template`, removing
+// the study's trial template.
+func (c *TemplateController) Delete(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	id := "/studies/" + p.ByName("study")
+	err := c.store.Update(func(tx Tx) error {
+		old, err := tx.Get(templateBucket, []byte(id))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return errorf(http.StatusNotFound, "%s/template not found", id)
+		}
+		return tx.Delete(templateBucket, []byte(id))
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
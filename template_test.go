@@ -0,0 +1,261 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure trials posted to a study take on the defaults of its template.
+func TestTemplate(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	res := send(t, "PUT", srv.addr+"/studies/a", strings.NewReader(`{}`))
+	res.Body.Close()
+	res = send(t, "PUT", srv.addr+"/studies/a/trials/t0",
+		strings.NewReader(`{"subject":"rat_1"}`))
+	res.Body.Close()
+
+	template := `{"defaults":{"camera":{"fps":500,"model":"X1"},` +
+		`"rig":"biplanar"},"required":["subject","camera.model"]}`
+	url := srv.addr + "/studies/a/template"
+	res = send(t, "PUT", url, strings.NewReader(template))
+	res.Body.Close()
+	if want, got := http.StatusCreated, res.StatusCode; want != got {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+	got, _ := json.Marshal(getDocument(t, url))
+	if string(got) != template {
+		t.Errorf("want template %s, got %s", template, got)
+	}
+
+	trialsURL := srv.addr + "/studies/a/trials"
+	for _, tt := range []struct {
+		trial, data string
+		want        int
+	}{
+		{"t1", `{"subject":"rat_3","camera":{"fps":1000}}`,
+			http.StatusCreated},
+		{"t2", `{"subject":"rat_4","rig":"mono"}`, http.StatusCreated},
+		{"t3", `{"camera":{"model":null}}`, http.StatusUnprocessableEntity},
+		{"t4", `{"subject":"rat_5","camera":"none"}`,
+			http.StatusUnprocessableEntity},
+		{"t5", `["rat_6"]`, http.StatusUnprocessableEntity},
+	} {
+		trial := `{"version":"0.1","resource":"trial",` +
+			`"id":"/studies/a/trials/` + tt.trial + `","data":` + tt.data + `}`
+		if got := postTrial(t, trialsURL, trial); tt.want != got {
+			t.Errorf("POST %s: want %d, got %d", tt.data, tt.want, got)
+		}
+	}
+
+	got, _ = json.Marshal(getDocument(t, trialsURL+"/t1"))
+	want := `{"camera":{"fps":1000,"model":"X1"},"rig":"biplanar",` +
+		`"subject":"rat_3"}`
+	if want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	// Resolving a trial applies the template as it is now, flagging the
+	// values the trial inherits from it.
+	trial := `{"version":"0.1","resource":"trial",` +
+		`"id":"/studies/a/trials/t9","data":{"subject":"rat_9",` +
+		`"rig":"biplanar"}}`
+	postTrial(t, trialsURL, trial)
+	for _, tt := range []resolveTest{
+		{"t1", want, map[string]string{
+			"data.rig":          "inherited",
+			"data.camera.model": "inherited",
+			"data.camera.fps":   "overridden",
+		}},
+		{"t0", `{"camera":{"fps":500,"model":"X1"},"rig":"biplanar",` +
+			`"subject":"rat_1"}`, map[string]string{
+			"data.rig":          "inherited",
+			"data.camera.model": "inherited",
+			"data.camera.fps":   "inherited",
+		}},
+		// values sent are the trial's own, even if equal to the defaults
+		{"t9", `{"camera":{"fps":500,"model":"X1"},"rig":"biplanar",` +
+			`"subject":"rat_9"}`, map[string]string{
+			"data.rig":          "overridden",
+			"data.camera.model": "inherited",
+			"data.camera.fps":   "inherited",
+		}},
+	} {
+		tt.check(t, trialsURL)
+	}
+
+	// Trials imported from csv files take on the defaults too.
+	header := map[string]string{"Content-Type": "text/csv"}
+	csv := "trial,subject,camera.fps\nt6,rat_7,250\nt7,,250\n"
+	res = sendWith(t, "POST", trialsURL, header, strings.NewReader(csv))
+	var report ImportReport
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	res.Body.Close()
+	if report.Created != 1 || len(report.Errors) != 1 ||
+		report.Errors[0].Trial != "t7" {
+		t.Errorf("want t6 created and t7 failing, got %+v", report)
+	}
+	got, _ = json.Marshal(getDocument(t, trialsURL+"/t6"))
+	want = `{"camera":{"fps":250,"model":"X1"},"rig":"biplanar",` +
+		`"subject":"rat_7"}`
+	if want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	// Trials created by a batch take on the defaults too.
+	batch := `[
+		{"op":"create","id":"/studies/a/trials/b1","data":{}},
+		{"op":"create","id":"/studies/a/trials/b2","data":{"subject":"rat_8"}}
+	]`
+	results, _ := postBatch(t, srv.addr+"/batch", batch)
+	if len(results) != 2 || results[0].Status != 422 ||
+		results[1].Status != 201 {
+		t.Errorf("want b1 failing and b2 created, got %+v", results)
+	}
+	got, _ = json.Marshal(getDocument(t, trialsURL+"/b2"))
+	want = `{"camera":{"fps":500,"model":"X1"},"rig":"biplanar",` +
+		`"subject":"rat_8"}`
+	if want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	// Trials updated in place must still hold the required values.
+	header = map[string]string{"Content-Type": "application/merge-patch+json"}
+	for _, tt := range []struct {
+		method, data string
+		want         int
+	}{
+		{"PATCH", `{"subject":null}`, http.StatusUnprocessableEntity},
+		{"PUT", `{"rig":"mono"}`, http.StatusUnprocessableEntity},
+		{"PUT", `{"subject":"rat_4"}`, http.StatusOK},
+	} {
+		res := sendWith(t, tt.method, trialsURL+"/t2", header,
+			strings.NewReader(tt.data))
+		res.Body.Close()
+		if got := res.StatusCode; tt.want != got {
+			t.Errorf("%s %s: want %d, got %d", tt.method, tt.data, tt.want,
+				got)
+		}
+	}
+
+	// Inherited values stay inherited through writes leaving them as they
+	// are, and take on the defaults of the template as it changes.
+	res = sendWith(t, "PATCH", trialsURL+"/t1", header,
+		strings.NewReader(`{"subject":"rat_2"}`))
+	res.Body.Close()
+	res = send(t, "PUT", url, strings.NewReader(`{"defaults":{"camera":`+
+		`{"fps":500,"model":"X2"},"rig":"mono"}}`))
+	res.Body.Close()
+	for _, tt := range []resolveTest{
+		{"t1", `{"camera":{"fps":1000,"model":"X2"},"rig":"mono",` +
+			`"subject":"rat_2"}`, map[string]string{
+			"data.rig":          "inherited",
+			"data.camera.model": "inherited",
+			"data.camera.fps":   "overridden",
+		}},
+		{"t9", `{"camera":{"fps":500,"model":"X2"},"rig":"biplanar",` +
+			`"subject":"rat_9"}`, map[string]string{
+			"data.rig":          "overridden",
+			"data.camera.model": "inherited",
+			"data.camera.fps":   "inherited",
+		}},
+	} {
+		tt.check(t, trialsURL)
+	}
+
+	// Templates go to the trash with their study, and come back with it.
+	status(t, "DELETE", srv.addr+"/studies/a")
+	if want, got := http.StatusNotFound, status(t, "GET", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	status(t, "POST", srv.addr+"/trash/studies/a/restore")
+	if want, got := http.StatusOK, status(t, "GET", url); want != got {
+		t.Errorf("want template restored, got %d", got)
+	}
+	if want, got := http.StatusNoContent,
+		status(t, "DELETE", url); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	trial = `{"version":"0.1","resource":"trial",` +
+		`"id":"/studies/a/trials/t8","data":{}}`
+	if want, got := http.StatusCreated,
+		postTrial(t, trialsURL, trial); want != got {
+		t.Errorf("want %d without template, got %d", want, got)
+	}
+
+	for _, tt := range []struct {
+		path, template string
+		want           int
+	}{
+		{"/studies/a/template", `{"defaults":[1]}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/template", `{"required":["a..b"]}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/template", `{"default":{}}`,
+			http.StatusUnprocessableEntity},
+		{"/studies/a/template", `{"defaults":`, http.StatusBadRequest},
+		{"/studies/b/template", `{}`, http.StatusNotFound},
+	} {
+		res := send(t, "PUT", srv.addr+tt.path,
+			strings.NewReader(tt.template))
+		res.Body.Close()
+		if got := res.StatusCode; tt.want != got {
+			t.Errorf("PUT %s %s: want %d, got %d", tt.path, tt.template,
+				tt.want, got)
+		}
+	}
+}
+
+// A resolveTest is a test case for resolving a trial, giving the data
+// payload and template flags expected.
+type resolveTest struct {
+	trial string
+	data  string
+	flags map[string]string
+}
+
+// check gets the trial resolved from the collection at url, checking it
+// against the test case.
+func (tt resolveTest) check(t *testing.T, url string) {
+	res := send(t, "GET", url+"/"+tt.trial, nil)
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	res = send(t, "GET", url+"/"+tt.trial+"?resolved=true", nil)
+	if got := res.Header.Get("ETag"); etag != got {
+		t.Errorf("resolve %s: want ETag %s, got %s", tt.trial, etag, got)
+	}
+	var resolved struct {
+		ID       string            `json:"id"`
+		Data     json.RawMessage   `json:"data"`
+		Template map[string]string `json:"template"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resolved); err != nil {
+		t.Fatalf("error decoding resolved trial: %v", err)
+	}
+	res.Body.Close()
+	if !strings.HasSuffix(resolved.ID, "/trials/"+tt.trial) {
+		t.Errorf("want id of %s, got %s", tt.trial, resolved.ID)
+	}
+	if string(resolved.Data) != tt.data {
+		t.Errorf("resolve %s: want %s, got %s", tt.trial, tt.data,
+			resolved.Data)
+	}
+	if !reflect.DeepEqual(tt.flags, resolved.Template) {
+		t.Errorf("resolve %s: want flags %v, got %v", tt.trial, tt.flags,
+			resolved.Template)
+	}
+}
+
+// postTrial posts the json-encoded trial to url, returning the response
+// status.
+func postTrial(t *testing.T, url, trial string) int {
+	res := send(t, "POST", url, strings.NewReader(trial))
+	res.Body.Close()
+	return res.StatusCode
+}
@@ -0,0 +1,326 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// NewTrashController initializes a new instance of our trash controller.
+func NewTrashController(host string, store Store,
+	config *Config) *TrashController {
+
+	return &TrashController{host, store, config}
+}
+
+// A TrashController handles requests for deleted resources.
+//
+// Deleted resources are moved to the store's trash bucket, keyed by the id
+// of the resource requested to be deleted.  Each trash item holds the
+// records of all resources deleted along with it, so that they can be
+// restored together until the trash is purged.
+type TrashController struct {
+	host   string
+	store  Store
+	config *Config
+}
+
+// trashed is the stored representation of a deleted resource.
+type trashed struct {
+	Deleted  string                     `json:"deleted"`            // time deleted
+	Deleter  string                     `json:"deleter,omitempty"`  // user deleting
+	Listed   string                     `json:"listed,omitempty"`   // studylist entry
+	Records  map[string]json.RawMessage `json:"records"`            // records, by id
+	Schemas  map[string]json.RawMessage `json:"schemas,omitempty"`  // schemas, by key
+	Template json.RawMessage            `json:"template,omitempty"` // trial template
+}
+
+// getTrashed returns the trash item for the resource id, or nil if the
+// resource isn't in the trash.
+func getTrashed(tx Tx, id string) (*trashed, error) {
+	v, err := tx.Get(trashBucket, []byte(id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	t := new(trashed)
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// trashRoots returns the ids at which the resources deleted along with the
+// resource id are rooted: a study's trial-level files are kept apart from
+// the study, and a trial's files apart from the trial.
+func trashRoots(id string) []string {
+	seg := strings.Split(id, "/")
+	switch resourceType(id) {
+	case "study":
+		return []string{id, "/files/" + seg[2]}
+	case "trial":
+		return []string{id, fmt.Sprintf("/files/%s/%s", seg[2], seg[4])}
+	}
+	return []string{id}
+}
+
+// moveToTrash moves the resource id to the trash, along with all resources
+// rooted at the given ids (which should include id itself), on behalf of
+// user.  It returns a summary of the resources moved.  If the resource is
+// already in the trash (e.g., it was deleted, recreated, and deleted
+// again), its new trash entry replaces the one before, and the resources
+// only trashed before are gone for good, as if purged.
+func moveToTrash(tx Tx, id string, roots []string,
+	user string) (*Summary, error) {
+
+	prev, err := getTrashed(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	t := &trashed{Records: map[string]json.RawMessage{}}
+
+	summary := &Summary{ID: id}
+	moved := false
+	for _, root := range roots {
+		items, err := tx.DeleteTree(studiesBucket, []byte(root))
+		if err != nil {
+			return nil, err
+		}
+		if err := unindexItems(tx, items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			t.Records[string(item.Key)] = item.Value
+			summary.count(string(item.Key))
+			moved = true
+		}
+	}
+	listed, err := tx.Get(studylistBucket, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	if listed != nil {
+		t.Listed = string(listed)
+		if err := tx.Delete(studylistBucket, []byte(id)); err != nil {
+			return nil, err
+		}
+		moved = true
+	}
+	if resourceType(id) == "study" {
+		schemas, err := tx.DeleteTree(schemaBucket, []byte(id))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range schemas {
+			if t.Schemas == nil {
+				t.Schemas = map[string]json.RawMessage{}
+			}
+			t.Schemas[string(item.Key)] = item.Value
+			moved = true
+		}
+		template, err := tx.Get(templateBucket, []byte(id))
+		if err != nil {
+			return nil, err
+		}
+		if template != nil {
+			t.Template = template
+			if err := tx.Delete(templateBucket, []byte(id)); err != nil {
+				return nil, err
+			}
+			moved = true
+		}
+	}
+	if !moved {
+		return summary, nil
+	}
+	if prev != nil {
+		for key := range prev.Records {
+			if _, ok := t.Records[key]; ok {
+				continue
+			}
+			if err := dropHistory(tx, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.Deleted = time.Now().UTC().Format(time.RFC3339Nano)
+	t.Deleter = user
+	v, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return summary, tx.Put(trashBucket, []byte(id), v)
+}
+
+// List handles GET requests for `/trash`, returning a list of the deleted
+// resources that can be restored.
+func (c *TrashController) List(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+
+	items, err := c.store.Items(trashBucket)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	entries := []*TrashEntry{}
+	for _, item := range items {
+		var t trashed
+		if err := json.Unmarshal(item.Value, &t); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id := string(item.Key)
+		entry := &TrashEntry{
+			Summary: Summary{ID: id},
+			Type:    resourceType(id),
+			URL:     "http://" + c.host + "/trash" + id + "/restore",
+			Deleted: t.Deleted,
+			Deleter: t.Deleter,
+		}
+		for key := range t.Records {
+			entry.count(key)
+		}
+		entries = append(entries, entry)
+	}
+
+	writeTagged(w, r, entries)
+}
+
+// Restore handles POST requests for `/trash/*id/restore`, restoring the
+// deleted resource id along with all resources deleted with it.  The
+// resource's parent must exist, and none of the resources may have been
+// recreated since they were deleted.
+func (c *TrashController) Restore(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	path := p.ByName("path")
+	if !strings.HasSuffix(path, "/restore") {
+		c.config.notFound(w, r, "/trash"+path)
+		return
+	}
+	id := strings.TrimSuffix(path, "/restore")
+
+	summary := &Summary{ID: id}
+	err := c.store.Update(func(tx Tx) error {
+		t, err := getTrashed(tx, id)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return errorf(http.StatusNotFound, "%s not found in trash", id)
+		}
+		if parent := parentID(id); parent != "" {
+			rec, err := getRecord(tx, parent)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				return errorf(http.StatusConflict,
+					"can't restore %s: %s doesn't exist", id, parent)
+			}
+		}
+		for key, v := range t.Records {
+			old, err := tx.Get(studiesBucket, []byte(key))
+			if err != nil {
+				return err
+			}
+			if old != nil {
+				return errorf(http.StatusConflict,
+					"can't restore %s: %s has been recreated", id, key)
+			}
+			if err := tx.Put(studiesBucket, []byte(key), v); err != nil {
+				return err
+			}
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if err := indexRecord(tx, key, nil, rec); err != nil {
+				return err
+			}
+			summary.count(key)
+		}
+		if t.Listed != "" {
+			err := tx.Put(studylistBucket, []byte(id), []byte(t.Listed))
+			if err != nil {
+				return err
+			}
+		}
+		for key, v := range t.Schemas {
+			if err := tx.Put(schemaBucket, []byte(key), v); err != nil {
+				return err
+			}
+		}
+		if len(t.Template) > 0 {
+			err := tx.Put(templateBucket, []byte(id), t.Template)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete(trashBucket, []byte(id))
+	})
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, data)
+}
+
+// purgeTrash permanently removes the resources deleted before the given
+// time from the trash of store, along with their revision histories,
+// returning the number of trash items removed.
+func purgeTrash(store Store, before time.Time) (n int, err error) {
+	err = store.Update(func(tx Tx) error {
+		n = 0
+		items, err := tx.Items(trashBucket)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			var t trashed
+			if err := json.Unmarshal(item.Value, &t); err != nil {
+				return err
+			}
+			deleted, err := time.Parse(time.RFC3339Nano, t.Deleted)
+			if err != nil {
+				return err
+			}
+			if !deleted.Before(before) {
+				continue
+			}
+			for key := range t.Records {
+				if err := dropHistory(tx, key); err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete(trashBucket, item.Key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// dropHistory drops the revision history of the trashed resource id once
+// it's gone for good, unless it has been recreated since (and so carries
+// its history on).
+func dropHistory(tx Tx, id string) error {
+	v, err := tx.Get(studiesBucket, []byte(id))
+	if err != nil || v != nil {
+		return err
+	}
+	_, err = tx.DeleteTree(historyBucket, []byte(id+"/@"))
+	return err
+}
@@ -0,0 +1,172 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure deleted resources are moved to the trash, from which they can be
+// restored.
+func TestTrash(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(`{"n":1}`))
+		res.Body.Close()
+	}
+
+	// Delete a trial-level file, then the whole study.
+	for _, path := range []string{"/files/a/t1/f2", "/studies/a"} {
+		header := map[string]string{"From": "ann@example.com"}
+		res := sendWith(t, "DELETE", srv.addr+path, header, nil)
+		res.Body.Close()
+		if want, got := http.StatusOK, res.StatusCode; want != got {
+			t.Errorf("DELETE %s: want %d, got %d", path, want, got)
+		}
+	}
+
+	entries := getTrash(t, srv.addr)
+	if want, got := 2, len(entries); want != got {
+		t.Fatalf("want %d trash entries, got %d", want, got)
+	}
+	study := entries[1]
+	if want, got := "/files/a/t1/f2", entries[0].ID; want != got {
+		t.Errorf("want %s trashed, got %s", want, got)
+	}
+	if study.ID != "/studies/a" || study.Type != "study" ||
+		study.Trials != 1 || study.Files != 1 {
+		t.Errorf("want study trashed with 1 trial and 1 file, got %+v", study)
+	}
+	if want, got := "ann@example.com", study.Deleter; want != got {
+		t.Errorf("want deleter %q, got %q", want, got)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, study.Deleted); err != nil {
+		t.Errorf("invalid deletion time: %v", err)
+	}
+	if want := "/trash/studies/a/restore"; !strings.HasSuffix(study.URL, want) {
+		t.Errorf("want restore url ending in %s, got %s", want, study.URL)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		// The file's trial must be restored first.
+		{"/trash/files/a/t1/f2/restore", http.StatusConflict},
+		{"/trash/studies/b/restore", http.StatusNotFound},
+		{"/trash/studies/a", http.StatusNotFound},
+		{"/trash/studies/a/restore", http.StatusOK},
+		{"/trash/studies/a/restore", http.StatusNotFound},
+		{"/trash/files/a/t1/f2/restore", http.StatusOK},
+	} {
+		if want, got := tt.status,
+			status(t, "POST", srv.addr+tt.path); want != got {
+			t.Errorf("POST %s: want %d, got %d", tt.path, want, got)
+		}
+	}
+
+	// Everything is back, including the study's listing.
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+	} {
+		want := map[string]interface{}{"n": 1.0}
+		if got := getDocument(t, srv.addr+path); !reflect.DeepEqual(want, got) {
+			t.Errorf("GET %s: want %v, got %v", path, want, got)
+		}
+	}
+	res := send(t, "GET", srv.addr+"/studies", nil)
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if want, got := 1, len(items); want != got {
+		t.Errorf("want %d study listed, got %d", want, got)
+	}
+	if want, got := 0, len(getTrash(t, srv.addr)); want != got {
+		t.Errorf("want %d trash entries, got %d", want, got)
+	}
+
+	// Resources recreated since being deleted aren't overwritten.
+	url := srv.addr + "/studies/a/files/f1"
+	status(t, "DELETE", url)
+	res = send(t, "PUT", url, strings.NewReader(`{"n":2}`))
+	res.Body.Close()
+	path := "/trash/studies/a/files/f1/restore"
+	if want, got := http.StatusConflict,
+		status(t, "POST", srv.addr+path); want != got {
+		t.Errorf("POST %s: want %d, got %d", path, want, got)
+	}
+
+	// Deleting a resource again replaces its earlier trash entry, so the
+	// trial comes back without the file deleted along with it before.
+	url = srv.addr + "/studies/a/trials/t1"
+	status(t, "DELETE", url)
+	res = send(t, "PUT", url, strings.NewReader(`{"n":3}`))
+	res.Body.Close()
+	status(t, "DELETE", url)
+	path = "/trash/studies/a/trials/t1/restore"
+	if want, got := http.StatusOK,
+		status(t, "POST", srv.addr+path); want != got {
+		t.Errorf("POST %s: want %d, got %d", path, want, got)
+	}
+	want := map[string]interface{}{"n": 3.0}
+	if got := getDocument(t, url); !reflect.DeepEqual(want, got) {
+		t.Errorf("GET %s: want %v, got %v", url, want, got)
+	}
+	path = "/files/a/t1/f2"
+	if want, got := http.StatusNotFound,
+		status(t, "GET", srv.addr+path); want != got {
+		t.Errorf("GET %s: want %d, got %d", path, want, got)
+	}
+
+	// Purging removes resources deleted before the retention period.
+	n, err := srv.server.PurgeTrash(time.Hour)
+	if err != nil || n != 0 {
+		t.Errorf("want nothing purged, got %d (%v)", n, err)
+	}
+	n, err = srv.server.PurgeTrash(0)
+	if err != nil || n != 1 {
+		t.Errorf("want 1 purged, got %d (%v)", n, err)
+	}
+	if want, got := 0, len(getTrash(t, srv.addr)); want != got {
+		t.Errorf("want %d trash entries, got %d", want, got)
+	}
+}
+
+// getTrash returns the list of trash entries retrieved from the server at
+// addr.
+func getTrash(t *testing.T, addr string) []TrashEntry {
+	res := send(t, "GET", addr+"/trash", nil)
+	defer res.Body.Close()
+
+	var entries []TrashEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatalf("error decoding trash: %v", err)
+	}
+	return entries
+}
+
+// A TrashEntry models a deleted resource, received as part of the trash.
+type TrashEntry struct {
+	ID      string `json:"id"`
+	Type    string `json:"resource"`
+	URL     string `json:"url"`
+	Deleted string `json:"deleted"`
+	Deleter string `json:"deleter"`
+	Trials  int    `json:"trials"`
+	Files   int    `json:"files"`
+}
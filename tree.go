@@ -0,0 +1,137 @@
+package xhub
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// depthParam returns the number of levels of descendants whose ids were
+// requested along with a resource, via either the `expand=children` or the
+// `depth=N` query parameter of r.  Expanding a resource's children is the
+// same as requesting a depth of 1.  The depth is zero if neither parameter
+// is given.
+func depthParam(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	if v := q.Get("depth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 0 {
+			return 0, fmt.Errorf("invalid depth parameter %q: expecting "+
+				"a non-negative integer", v)
+		}
+		return depth, nil
+	}
+	switch v := q.Get("expand"); v {
+	case "":
+		return 0, nil
+	case "children":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("invalid expand parameter %q: expecting "+
+			"children", v)
+	}
+}
+
+// childCollections returns the ids of the collections holding the children
+// of the resource id: the trials and files of a study, or the files of a
+// trial.  Files have no children.
+func childCollections(id string) []string {
+	switch resourceType(id) {
+	case "study":
+		return []string{id + "/trials", id + "/files"}
+	case "trial":
+		seg := strings.Split(id, "/")
+		return []string{fmt.Sprintf("/files/%s/%s", seg[2], seg[4])}
+	}
+	return nil
+}
+
+// resourceType returns the type of the resource id: "study", "trial", or
+// "file".  The type is empty if id doesn't identify a resource.
+func resourceType(id string) string {
+	seg := strings.Split(id, "/")
+	switch {
+	case len(seg) == 3 && seg[1] == "studies":
+		return "study"
+	case len(seg) == 5 && seg[1] == "studies" && seg[3] == "trials":
+		return "trial"
+	case len(seg) == 5 && seg[1] == "studies" && seg[3] == "files",
+		len(seg) == 5 && seg[1] == "files":
+		return "file"
+	}
+	return ""
+}
+
+// parentID returns the id of the resource containing the resource id: the
+// study of a trial or study-level file, or the trial of a trial-level
+// file.  Studies have no parent.
+func parentID(id string) string {
+	seg := strings.Split(id, "/")
+	switch resourceType(id) {
+	case "trial", "file":
+		if seg[1] == "files" {
+			return fmt.Sprintf("/studies/%s/trials/%s", seg[2], seg[3])
+		}
+		return "/studies/" + seg[2]
+	}
+	return ""
+}
+
+// childIDs returns the ids of the descendants of the resource id, down to
+// the given depth, with the ids of each resource's children following its
+// own id.
+func childIDs(tx Tx, id string, depth int) ([]string, error) {
+	if depth <= 0 {
+		return nil, nil
+	}
+	var ids []string
+	for _, parent := range childCollections(id) {
+		items, err := tx.Children(studiesBucket, []byte(parent))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			child := string(item.Key)
+			ids = append(ids, child)
+			grandchildren, err := childIDs(tx, child, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, grandchildren...)
+		}
+	}
+	return ids, nil
+}
+
+// buildTree returns the tree rooted at the resource id of type typ, given
+// its stored record.
+func buildTree(tx Tx, host, typ, id string, rec *record) (*Tree, error) {
+	tree := &Tree{Resource: newResource(host, typ, id, rec)}
+	for _, parent := range childCollections(id) {
+		items, err := tx.Children(studiesBucket, []byte(parent))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			rec, err := decodeRecord(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			typ := "file"
+			if strings.HasSuffix(parent, "/trials") {
+				typ = "trial"
+			}
+			child, err := buildTree(tx, host, typ, string(item.Key), rec)
+			if err != nil {
+				return nil, err
+			}
+			if typ == "trial" {
+				tree.Trials = append(tree.Trials, child)
+			} else {
+				tree.Files = append(tree.Files, child)
+			}
+		}
+	}
+	return tree, nil
+}
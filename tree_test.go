@@ -0,0 +1,152 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure the ids of a resource's children are included when expanded.
+func TestChildren(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/trials/t2",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+		"/files/a/t1/f3",
+	} {
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(`{}`))
+		res.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/studies/a", nil},
+		{"/studies/a?depth=0", nil},
+		{"/studies/a?expand=children", []string{
+			"/studies/a/trials/t1",
+			"/studies/a/trials/t2",
+			"/studies/a/files/f1",
+		}},
+		{"/studies/a?depth=2", []string{
+			"/studies/a/trials/t1",
+			"/files/a/t1/f2",
+			"/files/a/t1/f3",
+			"/studies/a/trials/t2",
+			"/studies/a/files/f1",
+		}},
+		{"/studies/a/trials/t1?expand=children", []string{
+			"/files/a/t1/f2",
+			"/files/a/t1/f3",
+		}},
+		{"/files/a/t1/f2?depth=5", nil},
+	} {
+		res := send(t, "GET", srv.addr+tt.path, nil)
+		var item Item
+		if err := json.NewDecoder(res.Body).Decode(&item); err != nil {
+			t.Fatalf("error decoding %s: %v", tt.path, err)
+		}
+		res.Body.Close()
+		if want, got := tt.want, item.Children; !reflect.DeepEqual(want, got) {
+			t.Errorf("GET %s: want children %v, got %v", tt.path, want, got)
+		}
+	}
+
+	// Listed studies and trials can be expanded too.
+	res := send(t, "GET", srv.addr+"/studies/a/trials?expand=children", nil)
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if want, got := 2, len(items); want != got {
+		t.Fatalf("want %d items, got %d", want, got)
+	}
+	want := []string{"/files/a/t1/f2", "/files/a/t1/f3"}
+	if got := items[0].Children; !reflect.DeepEqual(want, got) {
+		t.Errorf("want children %v, got %v", want, got)
+	}
+
+	res = send(t, "GET", srv.addr+"/studies?depth=1", nil)
+	items = nil
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if want, got := 1, len(items); want != got {
+		t.Fatalf("want %d items, got %d", want, got)
+	}
+	if want, got := 3, len(items[0].Children); want != got {
+		t.Errorf("want %d children, got %v", want, items[0].Children)
+	}
+
+	for _, path := range []string{
+		"/studies?depth=-1",
+		"/studies/a?depth=x",
+		"/studies/a/trials?expand=parents",
+	} {
+		if want, got := http.StatusBadRequest,
+			status(t, "GET", srv.addr+path); want != got {
+			t.Errorf("GET %s: want %d, got %d", path, want, got)
+		}
+	}
+}
+
+// Ensure a study's whole tree is returned in one nested document.
+func TestTree(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/t1",
+		"/studies/a/trials/t2",
+		"/studies/a/files/f1",
+		"/files/a/t1/f2",
+		"/studies/b/trials/t3",
+	} {
+		doc := `{"path":"` + path + `"}`
+		res := send(t, "PUT", srv.addr+path, strings.NewReader(doc))
+		res.Body.Close()
+	}
+
+	type node struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"resource"`
+		Data   json.RawMessage `json:"data"`
+		Files  []node          `json:"files"`
+		Trials []node          `json:"trials"`
+	}
+	leaf := func(typ, id string) node {
+		return node{ID: id, Type: typ, Data: json.RawMessage(`{"path":"` + id + `"}`)}
+	}
+
+	res := send(t, "GET", srv.addr+"/studies/a/tree", nil)
+	var got node
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("error decoding tree: %v", err)
+	}
+	res.Body.Close()
+
+	want := leaf("study", "/studies/a")
+	want.Files = []node{leaf("file", "/studies/a/files/f1")}
+	t1 := leaf("trial", "/studies/a/trials/t1")
+	t1.Files = []node{leaf("file", "/files/a/t1/f2")}
+	want.Trials = []node{t1, leaf("trial", "/studies/a/trials/t2")}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want tree\n%+v\ngot\n%+v", want, got)
+	}
+
+	if want, got := http.StatusNotFound,
+		status(t, "GET", srv.addr+"/studies/c/tree"); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
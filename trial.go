@@ -1,134 +1,152 @@
 package xhub
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
-	"github.com/joyrexus/buckets"
 	"github.com/julienschmidt/httprouter"
 )
 
 // NewTrialController initializes a new instance of our trial controller.
-func NewTrialController(host string, bux *buckets.DB) *TrialController {
-	// Create/open bucket for storing study-related data.
-	studies, err := bux.New([]byte("studies"))
-	if err != nil {
-		log.Fatalf("couldn't create/open studies bucket: %v\n", err)
-	}
-	return &TrialController{host, studies}
+func NewTrialController(host string, store Store,
+	config *Config) *TrialController {
+
+	return &TrialController{host, store, config}
 }
 
 // A TrialController handles requests for trial resources.
 type TrialController struct {
-	host    string
-	studies *buckets.Bucket
+	host   string
+	store  Store
+	config *Config
 }
 
 // Post handles POST requests for `/studies/:study/trials`, storing
-// the trial data sent.
+// the trial data sent.  A csv file sent creates or updates a trial for
+// each of its rows (see importTrials).
 func (c *TrialController) Post(w http.ResponseWriter, r *http.Request,
-	_ httprouter.Params) {
+	p httprouter.Params) {
 
-	var trial Resource
-	err := json.NewDecoder(r.Body).Decode(&trial)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	key := []byte(trial.ID)
-	if err := c.studies.Put(key, trial.Data); err != nil {
-		http.Error(w, err.Error(), 500)
+	if isCSV(r) {
+		importTrials(w, r, c.store, "/studies/"+p.ByName("study"))
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	parent := fmt.Sprintf("/studies/%s/trials", p.ByName("study"))
+	postResource(w, r, c.store, "trial", parent, nil)
 }
 
 // List handles GET requests for `/studies/:study/trials`, returning a list
-// of available trials for a particular study.
+// of available trials for a particular study.  Clients accepting csv
+// receive a csv file with a row for each trial (see exportTrials).
 func (c *TrialController) List(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	study := p.ByName("study")
-	prefix := fmt.Sprintf("/studies/%s/trials", study)
-	items, err := c.studies.PrefixItems([]byte(prefix))
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if accepts(r, csvType) {
+		exportTrials(w, r, c.host, c.store, "/studies/"+study)
 		return
 	}
-
-	resources := []*Resource{}
-
-	// Append each item to the list of resources.
-	for _, trial := range items {
-		id := string(trial.Key)
-		url := "http://" + c.host + id
-		rsc := &Resource{
-			Version: "1",
-			Type:    "trial",
-			ID:      id,
-			URL:     url,
-			Data:    trial.Value,
-		}
-		resources = append(resources, rsc)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resources)
+	parent := fmt.Sprintf("/studies/%s/trials", study)
+	listResources(w, r, c.host, c.store, "trial", parent)
 }
 
 // Get handles GET requests for `/studies/:study/trials/:trial`, returning
-// the raw json data payload for the requested trial.
+// the raw json data payload for the requested trial.  If the request's
+// resolved parameter is true, the trial is returned in an envelope with
+// its study's trial template applied (see resolveTrial).
 func (c *TrialController) Get(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	study, trial := p.ByName("study"), p.ByName("trial")
 	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
-	data, err := c.studies.Get([]byte(id))
+	resolved, err := boolParam(r, "resolved")
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if resolved {
+		resolveTrial(w, r, c.host, c.store, c.config, id)
 		return
 	}
-	if data == nil {
-		http.Error(w, id+" not found", http.StatusNoContent)
+	getResource(w, r, c.host, c.store, c.config, "trial", id)
+}
+
+// Put handles PUT requests for `/studies/:study/trials/:trial`, replacing
+// the json data payload of the requested trial with the json document sent.
+// The trial is created if it doesn't exist yet.
+func (c *TrialController) Put(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	study, trial := p.ByName("study"), p.ByName("trial")
+	if err := ValidateName(trial); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	putResource(w, r, c.store, id, nil)
+}
+
+// Patch handles PATCH requests for `/studies/:study/trials/:trial`,
+// applying the patch document sent (either a json merge patch or a json
+// patch) to the json data payload of the requested trial.
+func (c *TrialController) Patch(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	patchResource(w, r, c.store, id)
 }
 
 // Delete handles DELETE requests for `/studies/:study/trials/:trial`,
-// deleting all items from the studies bucket that are associated with
-// the specified study and trial.
+// moving all items in the studies bucket that are associated with the
+// specified study and trial to the trash.
 func (c *TrialController) Delete(w http.ResponseWriter, r *http.Request,
 	p httprouter.Params) {
 
 	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	deleteResources(w, r, c.store, c.config, id, trashRoots(id))
+}
 
-	// delete all items with these study + trial prefixes
-	for _, pre := range []string{
-		fmt.Sprintf("/studies/%s/trials/%s", study, trial),
-		fmt.Sprintf("/files/%s/%s", study, trial),
-	} {
-		items, err := c.studies.PrefixItems([]byte(pre))
-		if err != nil {
-			e := fmt.Sprintf("couldn't retrieve items with prefix %q: %v",
-				pre,
-				err,
-			)
-			http.Error(w, e, 500)
-			return
-		}
-		for _, item := range items {
-			if err := c.studies.Delete(item.Key); err != nil {
-				e := fmt.Sprintf("couldn't delete item %q: %v", item.Key, err)
-				http.Error(w, e, 500)
-			}
-		}
-	}
+// History handles GET requests for `/studies/:study/trials/:trial/history`,
+// returning a list of the revisions of the requested trial.
+func (c *TrialController) History(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	listHistory(w, r, c.host, c.store, c.config, id)
+}
+
+// Revision handles GET requests for
+// `/studies/:study/trials/:trial/history/:rev`, returning the raw json
+// data payload of the requested revision of the trial.
+func (c *TrialController) Revision(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	getHistory(w, r, c.host, c.store, c.config, "trial", id, p.ByName("rev"))
+}
+
+// Diff handles GET requests for `/studies/:study/trials/:trial/diff`,
+// returning a json patch between the revisions of the requested trial
+// given by the from and to parameters.
+func (c *TrialController) Diff(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+
+	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	diffHistory(w, r, c.store, id)
+}
+
+// Revert handles POST requests for `/studies/:study/trials/:trial/revert`,
+// restoring the revision of the requested trial given by the rev
+// parameter as a new revision.
+func (c *TrialController) Revert(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	study, trial := p.ByName("study"), p.ByName("trial")
+	id := fmt.Sprintf("/studies/%s/trials/%s", study, trial)
+	revertResource(w, r, c.store, id)
 }
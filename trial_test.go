@@ -49,8 +49,8 @@ func TestTrialMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 
@@ -71,8 +71,8 @@ func TestTrialMissing(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// No harm done.
-	if want, got := http.StatusOK, res.StatusCode; want != got {
+	// Missing resources can't be deleted.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
@@ -182,7 +182,7 @@ func TestTrialPersistence(t *testing.T) {
 	// Check expected URL of the one posted trial resource.
 	trialURL := "http://localhost:8081/studies/test_study/trials/test_trial"
 	if want, got := trialURL, items[0].URL; want != got {
-		t.Errorf("want %d item, got %d", want, got)
+		t.Errorf("want %s, got %s", want, got)
 	}
 
 	// -- GET -- //
@@ -239,8 +239,69 @@ func TestTrialPersistence(t *testing.T) {
 	}
 	res.Body.Close()
 
-	// Ensure we get a StatusNoContent (204) response.
-	if want, got := http.StatusNoContent, res.StatusCode; want != got {
+	// Ensure we get a StatusNotFound (404) response.
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+// Ensure deleting a trial leaves trials whose names it prefixes alone.
+func TestTrialDeleteSiblings(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, id := range []string{"trial_1", "trial_10"} {
+		trial := &Resource{
+			Version: "1",
+			Type:    "trial",
+			ID:      "/studies/test_study/trials/" + id,
+			Data:    map[string]string{"name": id},
+			Created: time.Now(),
+		}
+		url := srv.addr + "/studies/test_study/trials"
+		if want, got := http.StatusCreated, post(t, url, trial); want != got {
+			t.Errorf("want %d, got %d", want, got)
+		}
+		file := &Resource{
+			Version: "1",
+			Type:    "file",
+			ID:      "/files/test_study/" + id + "/test_file",
+			Data:    map[string]string{"name": "test_file"},
+			Created: time.Now(),
+		}
+		url = srv.addr + "/files/test_study/" + id
+		if want, got := http.StatusCreated, post(t, url, file); want != got {
+			t.Errorf("want %d, got %d", want, got)
+		}
+	}
+
+	url := srv.addr + "/studies/test_study/trials/trial_1"
+	if want, got := http.StatusOK, status(t, "DELETE", url); want != got {
 		t.Errorf("want %d, got %d", want, got)
 	}
+
+	// Ensure trial_10 and its file survived.
+	for _, id := range []string{
+		"/studies/test_study/trials/trial_10",
+		"/files/test_study/trial_10/test_file",
+	} {
+		if want, got := http.StatusOK, status(t, "GET", srv.addr+id); want != got {
+			t.Errorf("want %d, got %d getting %s", want, got, id)
+		}
+	}
+
+	// Ensure only trial_10 is listed.
+	res := send(t, "GET", srv.addr+"/studies/test_study/trials", nil)
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Errorf("decoding error: %v", err)
+	}
+	res.Body.Close()
+
+	if want, got := 1, len(items); want != got {
+		t.Fatalf("want %d item, got %d", want, got)
+	}
+	if want, got := "/studies/test_study/trials/trial_10", items[0].ID; want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
 }
@@ -0,0 +1,83 @@
+package xhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// acceptPatch lists the patch types accepted by PATCH handlers, for use
+// in Accept-Patch response headers.
+const acceptPatch = mergePatchType + ", " + jsonPatchType
+
+// readDocument reads the json document sent in the body of r.
+func readDocument(r *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decodeJSON(data); err != nil {
+		return nil, fmt.Errorf("invalid json document: %v", err)
+	}
+	return data, nil
+}
+
+// patchDocument applies the patch document sent in the body of r to data,
+// returning the patched document.  The patch is interpreted according to
+// the request's content type: either a json merge patch or a json patch.
+// If the patch can't be applied, the returned status is the http status
+// code describing the problem.
+func patchDocument(r *http.Request, data []byte) ([]byte, int, error) {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != mergePatchType && mediatype != jsonPatchType {
+		err := fmt.Errorf("unsupported patch type %q (expecting %s or %s)",
+			mediatype, mergePatchType, jsonPatchType)
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, http.StatusInternalServerError,
+			fmt.Errorf("stored document is invalid: %v", err)
+	}
+
+	if mediatype == mergePatchType {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			return nil, http.StatusBadRequest,
+				fmt.Errorf("invalid merge patch: %v", err)
+		}
+		doc = mergePatch(doc, patch)
+	} else {
+		patch, err := parseJSONPatch(body)
+		if err != nil {
+			return nil, http.StatusBadRequest,
+				fmt.Errorf("invalid json patch: %v", err)
+		}
+		if doc, err = patch.apply(doc); err != nil {
+			return nil, http.StatusConflict, err
+		}
+	}
+
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return patched, http.StatusOK, nil
+}
+
+// writeDocument responds with the given json document and status code.
+func writeDocument(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,225 @@
+package xhub_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure PUT requests create and replace resources.
+func TestPut(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/test_study",
+		"/studies/test_study/trials/test_trial",
+		"/studies/test_study/files/test_file",
+		"/files/test_study/test_trial/test_file",
+	} {
+		url := srv.addr + path
+
+		// The first PUT creates the resource.
+		doc := `{"name":"a","desc":"first"}`
+		res := send(t, "PUT", url, strings.NewReader(doc))
+		res.Body.Close()
+		if want, got := http.StatusCreated, res.StatusCode; want != got {
+			t.Errorf("PUT %s: want %d, got %d", path, want, got)
+		}
+
+		// The next one replaces it entirely.
+		doc = `{"name":"b"}`
+		res = send(t, "PUT", url, strings.NewReader(doc))
+		res.Body.Close()
+		if want, got := http.StatusOK, res.StatusCode; want != got {
+			t.Errorf("PUT %s: want %d, got %d", path, want, got)
+		}
+
+		want := map[string]interface{}{"name": "b"}
+		if got := getDocument(t, url); !reflect.DeepEqual(want, got) {
+			t.Errorf("GET %s: want %v, got %v", path, want, got)
+		}
+	}
+
+	// Ensure the study put is listed.
+	res := send(t, "GET", srv.addr+"/studies", nil)
+	var items []Item
+	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Errorf("decoding error: %v", err)
+	}
+	res.Body.Close()
+	if want, got := 1, len(items); want != got {
+		t.Errorf("want %d item, got %d", want, got)
+	}
+
+	// Ensure invalid documents and names are rejected.
+	url := srv.addr + "/studies/test_study/trials/test_trial"
+	res = send(t, "PUT", url, strings.NewReader(`{"name":`))
+	res.Body.Close()
+	if want, got := http.StatusBadRequest, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	url = srv.addr + "/studies/test_study/trials/trials"
+	res = send(t, "PUT", url, strings.NewReader(`{}`))
+	res.Body.Close()
+	if want, got := http.StatusUnprocessableEntity, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+// Ensure PATCH requests apply merge patches and json patches.
+func TestPatch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	path := "/studies/test_study/trials/test_trial"
+	url := srv.addr + path
+	doc := `{"name":"a","subject":"rat_1","tags":["x","y"],"rig":{"fps":250}}`
+	res := send(t, "PUT", url, strings.NewReader(doc))
+	res.Body.Close()
+
+	for _, tt := range []struct {
+		ctype, patch string
+		status       int
+		want         string
+	}{
+		{
+			"application/merge-patch+json",
+			`{"subject":"rat_3","rig":{"fps":500,"cams":2},"name":null}`,
+			http.StatusOK,
+			`{"subject":"rat_3","tags":["x","y"],"rig":{"fps":500,"cams":2}}`,
+		},
+		{
+			"application/json-patch+json",
+			`[
+				{"op":"test","path":"/subject","value":"rat_3"},
+				{"op":"add","path":"/tags/1","value":"w"},
+				{"op":"remove","path":"/tags/0"},
+				{"op":"replace","path":"/rig/fps","value":1000},
+				{"op":"copy","from":"/subject","path":"/orig"},
+				{"op":"move","from":"/rig/cams","path":"/cams"}
+			]`,
+			http.StatusOK,
+			`{"subject":"rat_3","tags":["w","y"],"rig":{"fps":1000},"orig":"rat_3","cams":2}`,
+		},
+		{
+			// A failed test leaves the document untouched.
+			"application/json-patch+json",
+			`[
+				{"op":"remove","path":"/orig"},
+				{"op":"test","path":"/subject","value":"rat_1"}
+			]`,
+			http.StatusConflict,
+			`{"subject":"rat_3","tags":["w","y"],"rig":{"fps":1000},"orig":"rat_3","cams":2}`,
+		},
+		{
+			"application/json-patch+json",
+			`[{"op":"remove","path":"/missing"}]`,
+			http.StatusConflict,
+			`{"subject":"rat_3","tags":["w","y"],"rig":{"fps":1000},"orig":"rat_3","cams":2}`,
+		},
+		{
+			"application/json-patch+json",
+			`[{"op":"frob","path":"/subject"}]`,
+			http.StatusBadRequest,
+			`{"subject":"rat_3","tags":["w","y"],"rig":{"fps":1000},"orig":"rat_3","cams":2}`,
+		},
+		{
+			"application/json",
+			`{"subject":"rat_2"}`,
+			http.StatusUnsupportedMediaType,
+			`{"subject":"rat_3","tags":["w","y"],"rig":{"fps":1000},"orig":"rat_3","cams":2}`,
+		},
+	} {
+		req, err := http.NewRequest("PATCH", url, strings.NewReader(tt.patch))
+		if err != nil {
+			t.Fatalf("error creating patch request: %v", err)
+		}
+		req.Header.Set("Content-Type", tt.ctype)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error patching %s: %v", path, err)
+		}
+		res.Body.Close()
+
+		if want, got := tt.status, res.StatusCode; want != got {
+			t.Errorf("PATCH %s (%s): want %d, got %d",
+				tt.patch, tt.ctype, want, got)
+		}
+		var want interface{}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("error decoding %s: %v", tt.want, err)
+		}
+		if got := getDocument(t, url); !reflect.DeepEqual(want, got) {
+			t.Errorf("PATCH %s (%s):\nwant %v\n got %v",
+				tt.patch, tt.ctype, want, got)
+		}
+	}
+
+	// Patching a missing resource fails.
+	req, err := http.NewRequest("PATCH", url+"0", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("error creating patch request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error patching %s: %v", path, err)
+	}
+	res.Body.Close()
+	if want, got := http.StatusNotFound, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+// Ensure the study edit page saves the study description.
+func TestSave(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	doc := `{"name":"test_study","desc":"old","pi":"someone"}`
+	res := send(t, "PUT", srv.addr+"/studies/test_study", strings.NewReader(doc))
+	res.Body.Close()
+
+	form := url.Values{"desc": {"new"}}
+	res, err := http.PostForm(srv.addr+"/save/studies/test_study", form)
+	if err != nil {
+		t.Fatalf("error saving study: %v", err)
+	}
+	page, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	// We're redirected to the study's view page.
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	if want := "new"; !strings.Contains(string(page), want) {
+		t.Errorf("want page containing %q, got %s", want, page)
+	}
+
+	want := map[string]interface{}{
+		"name": "test_study",
+		"desc": "new",
+		"pi":   "someone",
+	}
+	got := getDocument(t, srv.addr+"/studies/test_study")
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// getDocument returns the decoded json document retrieved from url.
+func getDocument(t *testing.T, url string) interface{} {
+	res := send(t, "GET", url, nil)
+	defer res.Body.Close()
+
+	var doc interface{}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatalf("error decoding %s: %v", url, err)
+	}
+	return doc
+}
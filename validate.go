@@ -0,0 +1,101 @@
+package xhub
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxNameLength is the maximum length of a resource name, in characters.
+const MaxNameLength = 128
+
+// reserved lists names that can't be used for studies, trials, or files,
+// since they name the collections in resource ids.
+var reserved = map[string]bool{
+	"files":  true,
+	"trials": true,
+}
+
+// ValidateName checks that name is a valid name for a study, trial, or file
+// (i.e., the last segment of the resource's id), returning an error that
+// explains the problem if it isn't.
+//
+// A valid name is between 1 and MaxNameLength characters long and consists
+// solely of letters, digits, combining marks, and the punctuation
+// characters ".", "_", and "-".  Letters and digits may be drawn from any
+// script, but the name must be in Unicode normalization form C (NFC), so
+// that names that look identical are also stored identically.  The names
+// ".", "..", "files", and "trials" are reserved.
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("name %q is not valid UTF-8", name)
+	}
+	if n := utf8.RuneCountInString(name); n > MaxNameLength {
+		return fmt.Errorf("name %q is %d characters long (maximum is %d)",
+			name, n, MaxNameLength)
+	}
+	if nfc := norm.NFC.String(name); nfc != name {
+		return fmt.Errorf("name %q is not in Unicode normalization form C "+
+			"(use %q instead)", name, nfc)
+	}
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsMark(r):
+		case r == '.', r == '_', r == '-':
+		default:
+			return fmt.Errorf("name %q contains %q (names may only contain "+
+				"letters, digits, \".\", \"_\", and \"-\")", name, r)
+		}
+	}
+	if name == "." || name == ".." || reserved[name] {
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	return nil
+}
+
+// checkResource ensures that a resource posted to the collection at parent
+// (e.g., `/studies/STUDY_A/trials`) belongs there: its type must be typ
+// and its id must name a direct child of parent with a valid name.
+func checkResource(rsc *Resource, typ, parent string) error {
+	if rsc.Type != typ {
+		return fmt.Errorf("resource type %q doesn't match endpoint %s "+
+			"(expecting %q)", rsc.Type, parent, typ)
+	}
+	name := strings.TrimPrefix(rsc.ID, parent+"/")
+	if name == rsc.ID || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("resource id %q doesn't match endpoint %s "+
+			"(expecting %s/NAME)", rsc.ID, parent, parent)
+	}
+	if err := ValidateName(name); err != nil {
+		return fmt.Errorf("invalid resource id %q: %v", rsc.ID, err)
+	}
+	return nil
+}
+
+// checkID ensures that id identifies a study, trial, or file, and that the
+// names within it are valid.
+func checkID(id string) error {
+	if resourceType(id) == "" {
+		return fmt.Errorf("%q doesn't identify a study, trial, or file", id)
+	}
+	seg := strings.Split(id, "/")
+	names := seg[2:] // e.g., STUDY, TRIAL, and FILE in /files/STUDY/TRIAL/FILE
+	if seg[1] == "studies" {
+		names = []string{seg[2]}
+		if len(seg) == 5 {
+			names = append(names, seg[4])
+		}
+	}
+	for _, name := range names {
+		if err := ValidateName(name); err != nil {
+			return fmt.Errorf("invalid resource id %q: %v", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package xhub_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joyrexus/xhub"
+)
+
+// Ensure we accept valid names and reject invalid ones.
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{
+		"study_a",
+		"trial-10",
+		"cal.2016-03-01.tif",
+		"Ünïcödé",
+		"研究",
+		strings.Repeat("x", xhub.MaxNameLength),
+	} {
+		if err := xhub.ValidateName(name); err != nil {
+			t.Errorf("want %q to be valid, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		".",
+		"..",
+		"files",
+		"trials",
+		"a/b",
+		"a b",
+		"a?b",
+		"a%2Fb",
+		"Cafe\u0301", // not NFC
+		"\xff",
+		strings.Repeat("x", xhub.MaxNameLength+1),
+	} {
+		if err := xhub.ValidateName(name); err == nil {
+			t.Errorf("want %q to be invalid", name)
+		}
+	}
+}
+
+// Ensure posts of resources with invalid names are rejected with an
+// explanation.
+func TestPostInvalidName(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	trial := &Resource{
+		Version: "1",
+		Type:    "trial",
+		ID:      "/studies/test_study/trials/trial 1",
+		Data:    map[string]string{"name": "trial 1"},
+		Created: time.Now(),
+	}
+	body, err := trial.Encode()
+	if err != nil {
+		t.Fatalf("could not encode trial: %v", err)
+	}
+	url := srv.addr + "/studies/test_study/trials"
+	res, err := http.Post(url, "application/json", body)
+	if err != nil {
+		t.Fatalf("error posting trial: %v", err)
+	}
+	msg, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("error reading response: %v", err)
+	}
+	res.Body.Close()
+
+	if want, got := http.StatusUnprocessableEntity, res.StatusCode; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	if want := `contains ' '`; !strings.Contains(string(msg), want) {
+		t.Errorf("want message containing %q, got %q", want, msg)
+	}
+}
@@ -4,23 +4,29 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
-	"github.com/joyrexus/buckets"
 	"github.com/julienschmidt/httprouter"
 )
 
 const verbose = true // if `true` you'll see log output
 
-// NewServer creates a new studies server instance.
+// NewServer creates a new studies server instance, persisting study data
+// in the buckets database at dbpath.
 func NewServer(addr, dbpath string) *Server {
 	// Open a buckets database.
-	bux, err := buckets.Open(dbpath)
+	store, err := OpenBucketStore(dbpath)
 	if err != nil {
 		log.Fatalf("couldn't open buckets db %q: %v\n", dbpath, err)
 	}
+	return NewServerWithStore(addr, store)
+}
 
+// NewServerWithStore creates a new studies server instance, persisting
+// study data in the given store.
+func NewServerWithStore(addr string, store Store) *Server {
 	// Initialize our controller for handling specific routes.
-	control := NewController(addr, bux)
+	control := NewController(addr, store)
 
 	// Create and setup our router.
 	mux := httprouter.New()
@@ -29,73 +35,198 @@ func NewServer(addr, dbpath string) *Server {
 	mux.POST("/studies", control.Study.Post)
 	mux.GET("/studies", control.Study.List)
 	mux.GET("/studies/:study", control.Study.Get)
+	mux.PUT("/studies/:study", control.Study.Put)
+	mux.PATCH("/studies/:study", control.Study.Patch)
 	mux.DELETE("/studies/:study", control.Study.Delete)
+	mux.GET("/studies/:study/tree", control.Study.Tree)
+	mux.GET("/studies/:study/history", control.Study.History)
+	mux.GET("/studies/:study/history/:rev", control.Study.Revision)
+	mux.GET("/studies/:study/diff", control.Study.Diff)
+	mux.POST("/studies/:study/revert", control.Study.Revert)
 
 	// Setup trial handlers.
 	mux.POST("/studies/:study/trials", control.Trial.Post)
 	mux.GET("/studies/:study/trials", control.Trial.List)
 	mux.GET("/studies/:study/trials/:trial", control.Trial.Get)
+	mux.PUT("/studies/:study/trials/:trial", control.Trial.Put)
+	mux.PATCH("/studies/:study/trials/:trial", control.Trial.Patch)
 	mux.DELETE("/studies/:study/trials/:trial", control.Trial.Delete)
+	mux.GET("/studies/:study/trials/:trial/history", control.Trial.History)
+	mux.GET("/studies/:study/trials/:trial/history/:rev", control.Trial.Revision)
+	mux.GET("/studies/:study/trials/:trial/diff", control.Trial.Diff)
+	mux.POST("/studies/:study/trials/:trial/revert", control.Trial.Revert)
 
 	// Setup study-level file handlers.
 	mux.POST("/studies/:study/files", control.File.Post)
 	mux.GET("/studies/:study/files", control.File.List)
 	mux.GET("/studies/:study/files/:file", control.File.Get)
+	mux.PUT("/studies/:study/files/:file", control.File.Put)
+	mux.PATCH("/studies/:study/files/:file", control.File.Patch)
 	mux.DELETE("/studies/:study/files/:file", control.File.Delete)
+	mux.GET("/studies/:study/files/:file/history", control.File.History)
+	mux.GET("/studies/:study/files/:file/history/:rev", control.File.Revision)
+	mux.GET("/studies/:study/files/:file/diff", control.File.Diff)
+	mux.POST("/studies/:study/files/:file/revert", control.File.Revert)
 
 	// Setup trial-level file handlers.
 	mux.POST("/files/:study/:trial", control.File.Post)
 	mux.GET("/files/:study/:trial", control.File.List)
 	mux.GET("/files/:study/:trial/:file", control.File.Get)
+	mux.PUT("/files/:study/:trial/:file", control.File.Put)
+	mux.PATCH("/files/:study/:trial/:file", control.File.Patch)
 	mux.DELETE("/files/:study/:trial/:file", control.File.Delete)
+	mux.GET("/files/:study/:trial/:file/history", control.File.History)
+	mux.GET("/files/:study/:trial/:file/history/:rev", control.File.Revision)
+	mux.GET("/files/:study/:trial/:file/diff", control.File.Diff)
+	mux.POST("/files/:study/:trial/:file/revert", control.File.Revert)
+
+	// Setup trash handlers.
+	mux.GET("/trash", control.Trash.List)
+	mux.POST("/trash/*path", control.Trash.Restore)
+
+	// Setup index handlers.
+	mux.GET("/lookup", control.Index.Lookup)
+	mux.GET("/search", control.Search.Search)
+
+	// Setup batch handlers.
+	mux.POST("/batch", control.Batch.Post)
+
+	// Setup schema handlers.
+	mux.GET("/studies/:study/schemas/:resource", control.Schema.Get)
+	mux.PUT("/studies/:study/schemas/:resource", control.Schema.Put)
+	mux.DELETE("/studies/:study/schemas/:resource", control.Schema.Delete)
+	mux.POST("/studies/:study/schemas/:resource/validate",
+		control.Schema.Validate)
+	mux.GET("/studies/:study/schemas/:resource/report", control.Schema.Report)
+
+	// Setup template handlers.
+	mux.GET("/studies/:study/template", control.Template.Get)
+	mux.PUT("/studies/:study/template", control.Template.Put)
+	mux.DELETE("/studies/:study/template", control.Template.Delete)
 
 	// Setup index/make/view/edit handlers.
 	// mux.GET("/view/studies", control.Study.Index)
 	// mux.GET("/make/studies", control.Study.Make)
-	mux.POST("/save/studies", control.Study.Save)
+	mux.POST("/save/studies/:study", control.Study.Save)
 	mux.GET("/view/studies/:study", control.Study.View)
 	mux.GET("/edit/studies/:study", control.Study.Edit)
 
-	return &Server{addr, mux, bux}
+	return &Server{
+		Addr:    addr,
+		Config:  control.Config,
+		handler: mux,
+		store:   store,
+	}
 }
 
 // A Server is an http handler providing the studies service API.
 type Server struct {
 	Addr    string
+	Config  *Config // shared with the server's controllers
 	handler *httprouter.Router
-	db      *buckets.DB
+	store   Store
+}
+
+// Config holds settings adjusting how a server handles requests.  Settings
+// should not be changed once the server has started handling requests.
+type Config struct {
+	// LegacyNoContent makes requests for missing resources receive a
+	// 204 No Content response rather than 404 Not Found, as expected by
+	// older xpub clients.
+	LegacyNoContent bool
+
+	// IdempotencyWindow is how long the response to a POST request
+	// carrying an Idempotency-Key header is replayed to requests
+	// carrying the same key.  A window of 0 disables the header.
+	IdempotencyWindow time.Duration
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(idempotencyHeader)
+	if r.Method == "POST" && key != "" && s.Config.IdempotencyWindow > 0 {
+		s.serveIdempotent(w, r, key)
+		return
+	}
 	s.handler.ServeHTTP(w, r)
 }
 
 // ListenAndServe starts the http service.
 func (s *Server) ListenAndServe() error {
-	return http.ListenAndServe(s.Addr, s.handler)
+	return http.ListenAndServe(s.Addr, s)
+}
+
+// PurgeTrash permanently removes resources deleted more than the given
+// duration ago, returning the number of deleted resources (with all the
+// resources deleted along with them) removed from the trash.
+func (s *Server) PurgeTrash(retention time.Duration) (int, error) {
+	return purgeTrash(s.store, time.Now().Add(-retention))
 }
 
-// Close closes the server's database.
+// PurgeResponses removes the responses kept for requests carrying an
+// Idempotency-Key header once they're older than the configured window,
+// returning the number of responses removed.
+func (s *Server) PurgeResponses() (int, error) {
+	return purgeResponses(s.store,
+		time.Now().Add(-s.Config.IdempotencyWindow))
+}
+
+// Reindex declares the indexes of the server's store, replacing any
+// declared before, and rebuilds them from the stored resources.  Declaring
+// the same indexes again rebuilds them, e.g. after the store has been
+// changed by an older version of the server.
+func (s *Server) Reindex(indexes Indexes) error {
+	return reindex(s.store, indexes)
+}
+
+// Indexes returns the indexes declared for the server's store.
+func (s *Server) Indexes() (indexes Indexes, err error) {
+	err = s.store.View(func(tx Tx) error {
+		indexes, err = getIndexes(tx)
+		return err
+	})
+	return indexes, err
+}
+
+// Close closes the server's store.
 func (s *Server) Close() {
-	s.db.Close()
+	s.store.Close()
 }
 
 /* -- CONTROLLER -- */
 
 // NewController initializes a new instance of our controller.
-// It provides handler methods for our router.
-func NewController(host string, bux *buckets.DB) *Controller {
-	study := NewStudyController(host, bux)
-	trial := NewTrialController(host, bux)
-	file := NewFileController(host, bux)
-	return &Controller{study, trial, file}
+// It provides handler methods for our router.  The contents of the
+// given store are migrated to the current storage layout if necessary.
+func NewController(host string, store Store) *Controller {
+	if err := Migrate(store); err != nil {
+		log.Fatalf("couldn't migrate store: %v\n", err)
+	}
+	config := &Config{IdempotencyWindow: DefaultIdempotencyWindow}
+	study := NewStudyController(host, store, config)
+	trial := NewTrialController(host, store, config)
+	file := NewFileController(host, store, config)
+	trash := NewTrashController(host, store, config)
+	index := NewIndexController(host, store, config)
+	search := NewSearchController(host, store, config)
+	batch := NewBatchController(host, store, config)
+	schema := NewSchemaController(host, store, config)
+	template := NewTemplateController(host, store, config)
+	return &Controller{study, trial, file, trash, index, search, batch,
+		schema, template, config}
 }
 
 // A Controller provides handler methods for our router.
 type Controller struct {
-	Study *StudyController
-	Trial *TrialController
-	File  *FileController
+	Study    *StudyController
+	Trial    *TrialController
+	File     *FileController
+	Trash    *TrashController
+	Index    *IndexController
+	Search   *SearchController
+	Batch    *BatchController
+	Schema   *SchemaController
+	Template *TemplateController
+	Config   *Config
 }
 
 /* -- MODELS --*/
@@ -107,6 +238,151 @@ type Resource struct {
 	ID       string          `json:"id"`       // resource identifier/name
 	URL      string          `json:"url"`      // resource url
 	Data     json.RawMessage `json:"data"`
-	Created  string          `json:"created,omitempty"`
+	Created  string          `json:"created,omitempty"`  // time created
+	Modified string          `json:"modified,omitempty"` // time last modified
+	Author   string          `json:"author,omitempty"`   // user who created it
+	Editor   string          `json:"editor,omitempty"`   // user who last modified it
 	Children []string        `json:"children,omitempty"`
+	ETag     string          `json:"etag,omitempty"` // entity tag of revision
+}
+
+// A Tree models a resource along with all of its descendants: the files
+// and trials of a study, or the files of a trial.
+type Tree struct {
+	*Resource
+	Files  []*Tree `json:"files,omitempty"`
+	Trials []*Tree `json:"trials,omitempty"`
+}
+
+// A Revision models an entry in the history of a resource.
+type Revision struct {
+	Rev      int    `json:"rev"`              // revision number
+	URL      string `json:"url"`              // revision url
+	Modified string `json:"modified"`         // time written
+	Editor   string `json:"editor,omitempty"` // user who wrote it
+	Size     int    `json:"size"`             // size of data payload, in bytes
+}
+
+// A Summary reports the number of trials and files deleted (or restored)
+// by a request, along with the resource requested.
+type Summary struct {
+	ID     string `json:"id"`     // id of resource requested
+	Trials int    `json:"trials"` // number of trials affected
+	Files  int    `json:"files"`  // number of files affected
+}
+
+// count adds the resource id to the summary.
+func (s *Summary) count(id string) {
+	switch resourceType(id) {
+	case "trial":
+		s.Trials++
+	case "file":
+		s.Files++
+	}
+}
+
+// A TrashEntry models a deleted resource, which can be restored along
+// with the resources deleted with it.
+type TrashEntry struct {
+	Summary
+	Type    string `json:"resource"` // "study", "trial", "file"
+	URL     string `json:"url"`      // url for restoring the resource
+	Deleted string `json:"deleted"`  // time deleted
+	Deleter string `json:"deleter,omitempty"`
+}
+
+// A SearchResult models a resource matching a full-text search, along with
+// the text it matched and the resources it belongs to.
+type SearchResult struct {
+	*Resource
+	Score   float64 `json:"score"`           // relevance, higher is better
+	Field   string  `json:"field"`           // path of matching text
+	Snippet string  `json:"snippet"`         // excerpt of matching text
+	Study   string  `json:"study,omitempty"` // id of the study it belongs to
+	Trial   string  `json:"trial,omitempty"` // id of the trial it belongs to
+}
+
+// An ImportReport summarizes the trials imported from a csv file, listing
+// the rows that couldn't be imported.
+type ImportReport struct {
+	Study     string      `json:"study"`     // id of the study imported to
+	Created   int         `json:"created"`   // number of trials created
+	Updated   int         `json:"updated"`   // number of trials updated
+	Unchanged int         `json:"unchanged"` // number of rows changing nothing
+	Errors    []*RowError `json:"errors"`    // rows that couldn't be imported
+}
+
+// A RowError describes why a row of a csv file couldn't be imported.
+type RowError struct {
+	Row    int    `json:"row"`             // row number, the header being 1
+	Trial  string `json:"trial,omitempty"` // name of the trial on the row
+	Detail string `json:"detail"`          // explanation of the problem
+}
+
+// An Operation models a change to a study, trial, or file requested as
+// part of a batch: creating the resource with the given data payload,
+// updating it with a new one, or deleting it.  If an ETag is given, the
+// operation only applies to that revision, as with If-Match.
+type Operation struct {
+	Op   string          `json:"op"`             // "create", "update", "delete"
+	ID   string          `json:"id"`             // id of resource to change
+	Data json.RawMessage `json:"data,omitempty"` // new data payload
+	ETag string          `json:"etag,omitempty"` // entity tag to match
+}
+
+// An OperationResult reports the outcome of an operation in a batch: its
+// http status, along with the ETag of the revision written, the resources
+// deleted, or an explanation of the failure.
+type OperationResult struct {
+	ID      string   `json:"id"`                // id of resource changed
+	Status  int      `json:"status"`            // http status code
+	ETag    string   `json:"etag,omitempty"`    // entity tag written
+	Deleted *Summary `json:"deleted,omitempty"` // resources deleted
+	Detail  string   `json:"detail,omitempty"`  // explanation of failure
+
+	// Violations lists how the data payload written fails to match the
+	// schema of its study, if that's why the operation failed.
+	Violations []*Violation `json:"violations,omitempty"`
+}
+
+// A Violation describes a value within the data payload of a trial or file
+// that fails to match the schema of its study.
+type Violation struct {
+	Path   string `json:"path"`   // path of the value, e.g. `data.subject`
+	Detail string `json:"detail"` // explanation of the problem
+}
+
+// A Validation reports whether the data payload of a resource matches the
+// schema of its study, listing the violations if it doesn't.
+type Validation struct {
+	ID         string       `json:"id,omitempty"` // id of resource checked
+	Valid      bool         `json:"valid"`
+	Violations []*Violation `json:"violations"`
+}
+
+// A SchemaReport lists the trials or files of a study whose data payloads
+// fail to match the study's schema for them.
+type SchemaReport struct {
+	Study   string        `json:"study"`    // id of study checked
+	Type    string        `json:"resource"` // "trial" or "file"
+	Checked int           `json:"checked"`  // number of resources checked
+	Failed  []*Validation `json:"failed"`   // resources failing the schema
+}
+
+// A Template models the defaults and requirements of the data payloads of
+// a study's trials.  The defaults are merged under the data payload of each
+// trial posted to the study, which must then hold a value at each of the
+// required paths (e.g., `camera.model`).
+type Template struct {
+	Defaults json.RawMessage `json:"defaults,omitempty"` // a json object
+	Required []string        `json:"required,omitempty"` // dotted paths
+}
+
+// A ResolvedTrial models a trial whose data payload has been merged over
+// the defaults of its study's trial template.  The path of each default
+// (e.g., `data.camera.model`) is flagged as "inherited" if the trial
+// leaves the default as it is, or "overridden" if it replaces it.
+type ResolvedTrial struct {
+	*Resource
+	Template map[string]string `json:"template"` // flags, by path
 }
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"testing"
 	"time"
 
 	"github.com/joyrexus/xhub"
@@ -99,15 +102,132 @@ func ExampleServer() {
 	// "test_study" retrieved
 }
 
+// Ensure resources posted to the wrong endpoint are rejected.
+func TestPostMismatch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path, typ, id string
+	}{
+		{"/studies", "trial", "/studies/a"},
+		{"/studies", "study", "/studies/a/trials/x"},
+		{"/studies", "study", "a"},
+		{"/studies/a/trials", "trial", "/studies/b/trials/x"},
+		{"/studies/a/trials", "trial", "/studies/a/trials/"},
+		{"/studies/a/trials", "file", "/studies/a/trials/x"},
+		{"/studies/a/files", "file", "/studies/a/trials/x"},
+		{"/studies/a/files", "file", "/studies/a/files/x/y"},
+		{"/files/a/x", "file", "/files/a/y/z"},
+		{"/files/a/x", "file", "/arbitrary"},
+	} {
+		rsc := &Resource{
+			Version: "1",
+			Type:    tt.typ,
+			ID:      tt.id,
+			Data:    map[string]string{"name": "x"},
+			Created: time.Now(),
+		}
+		got := post(t, srv.addr+tt.path, rsc)
+		if want := http.StatusUnprocessableEntity; want != got {
+			t.Errorf("posting %s %q to %s: want %d, got %d",
+				tt.typ, tt.id, tt.path, want, got)
+		}
+	}
+
+	// Ensure nothing was stored.
+	for _, path := range []string{
+		"/studies/b/trials/x",
+		"/studies/a/trials/x",
+		"/files/a/y/z",
+	} {
+		res := send(t, "GET", srv.addr+path, nil)
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			t.Errorf("want %s to be missing", path)
+		}
+	}
+}
+
+// Ensure errors are reported as problem details with fitting status codes.
+func TestProblems(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/studies/a", "", http.StatusNotFound},
+		{"GET", "/studies/a/trials/x", "", http.StatusNotFound},
+		{"GET", "/studies/a/files/x", "", http.StatusNotFound},
+		{"GET", "/files/a/x/y", "", http.StatusNotFound},
+		{"POST", "/studies", "{not json", http.StatusBadRequest},
+		{"POST", "/studies/a/trials", "", http.StatusBadRequest},
+		{"POST", "/files/a/x", `{"resource": 1}`, http.StatusBadRequest},
+	} {
+		res := send(t, tt.method, srv.addr+tt.path, strings.NewReader(tt.body))
+		var problem xhub.Problem
+		err := json.NewDecoder(res.Body).Decode(&problem)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s %s: error decoding problem: %v", tt.method, tt.path, err)
+			continue
+		}
+
+		if want, got := tt.status, res.StatusCode; want != got {
+			t.Errorf("%s %s: want %d, got %d", tt.method, tt.path, want, got)
+		}
+		want := "application/problem+json"
+		if got := res.Header.Get("Content-Type"); want != got {
+			t.Errorf("%s %s: want %s, got %s", tt.method, tt.path, want, got)
+		}
+		if want, got := tt.status, problem.Status; want != got {
+			t.Errorf("%s %s: want status %d, got %d",
+				tt.method, tt.path, want, got)
+		}
+		if want, got := tt.path, problem.Instance; want != got {
+			t.Errorf("%s %s: want instance %s, got %s",
+				tt.method, tt.path, want, got)
+		}
+		if problem.Detail == "" {
+			t.Errorf("%s %s: want problem detail", tt.method, tt.path)
+		}
+	}
+}
+
+// Ensure older clients can still get 204 responses for missing resources.
+func TestLegacyNoContent(t *testing.T) {
+	handler := xhub.NewServerWithStore("localhost:8081", xhub.NewMemStore())
+	handler.Config.LegacyNoContent = true
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/studies/a",
+		"/studies/a/trials/x",
+		"/studies/a/files/x",
+		"/files/a/x/y",
+	} {
+		for _, method := range []string{"GET", "DELETE"} {
+			got := status(t, method, srv.URL+path)
+			if want := http.StatusNoContent; want != got {
+				t.Errorf("%s %s: want %d, got %d", method, path, want, got)
+			}
+		}
+	}
+}
+
 func NewTestServer() *TestServer {
 	dbpath := tempfile()
-	handler := xhub.NewServer("localhost:8081", dbpath)
-	testsrv := httptest.NewServer(handler)
-	return &TestServer{testsrv, testsrv.URL, dbpath}
+	server := xhub.NewServer("localhost:8081", dbpath)
+	testsrv := httptest.NewServer(server)
+	return &TestServer{testsrv, server, testsrv.URL, dbpath}
 }
 
 type TestServer struct {
 	srv    *httptest.Server
+	server *xhub.Server
 	addr   string
 	dbpath string
 }
@@ -135,7 +255,11 @@ type Item struct {
 	URL      string `json:"url"`      // resource url
 	Data     json.RawMessage
 	Created  string   `json:"created,omitempty"`
+	Modified string   `json:"modified,omitempty"`
+	Author   string   `json:"author,omitempty"`
+	Editor   string   `json:"editor,omitempty"`
 	Children []string `json:"children,omitempty"`
+	ETag     string   `json:"etag,omitempty"`
 }
 
 // A Resource models an experimental resource.
@@ -158,6 +282,54 @@ func (r *Resource) Encode() (*bytes.Buffer, error) {
 
 /* -- UTILITY FUNCTIONS -- */
 
+// post sends rsc as a json-encoded POST request to url, returning the
+// response status code.
+func post(t *testing.T, url string, rsc *Resource) int {
+	body, err := rsc.Encode()
+	if err != nil {
+		t.Fatalf("could not encode %s: %v", rsc.ID, err)
+	}
+	res, err := http.Post(url, "application/json", body)
+	if err != nil {
+		t.Fatalf("error posting %s: %v", rsc.ID, err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// send sends a request with the given method and (optional) body to url,
+// returning the response.  The caller is responsible for closing the
+// response body.
+func send(t *testing.T, method, url string, body io.Reader) *http.Response {
+	return sendWith(t, method, url, nil, body)
+}
+
+// sendWith is like send, but also sets the given request headers.
+func sendWith(t *testing.T, method, url string, header map[string]string,
+	body io.Reader) *http.Response {
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("error creating %s request: %v", method, err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending %s %s: %v", method, url, err)
+	}
+	return res
+}
+
+// status sends a request with the given method to url, returning the
+// response status code.
+func status(t *testing.T, method, url string) int {
+	res := send(t, method, url, nil)
+	res.Body.Close()
+	return res.StatusCode
+}
+
 // tempfile returns a temporary file path.
 func tempfile() string {
 	f, err := ioutil.TempFile("", "bolt-")